@@ -0,0 +1,100 @@
+package main
+
+/**
+ * VCS backends, and finding which one a directory belongs to
+ */
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+)
+
+// The value of --vcs that picks a backend automatically
+const DetectBackend = "detect"
+
+type Backend interface {
+	// What --vcs calls it
+	Name() string
+	// Whether dir is the root of one of this backend's repositories
+	Detect(dir string) (Detection, bool)
+	// Return what was gathered, marked with markTimedOut, if ctx's deadline passes
+	Load(ctx context.Context, req Request, r *Renderer) *RepoInfo
+}
+
+// A repository found by a backend
+type Detection struct {
+	Backend Backend
+	Root    string
+	// Breaks ties between backends with a repository at the same root, like jj colocated with git
+	Confidence int
+	// Directories outside the root that affect the status, like a linked worktree's git directory
+	ExtraDirs []string
+}
+
+var backends = map[string]Backend{}
+
+// Called from each backend's init; the status codes are what the configuration file can change
+func registerBackend(backend Backend, fields RepoChangeStatusVCSFields) {
+	backends[backend.Name()] = backend
+	RepoChangeStatusFieldDefinitions[fields.VCS] = fields
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The innermost repositories containing dir, best first, from one walk up the tree.  Only the
+// named backend is considered unless vcs is DetectBackend.
+func detectRepos(dir string, vcs string) []Detection {
+	candidates := []Backend{}
+	if vcs == DetectBackend || vcs == "" {
+		for _, name := range backendNames() {
+			candidates = append(candidates, backends[name])
+		}
+	} else if backend, ok := backends[vcs]; ok {
+		candidates = append(candidates, backend)
+	}
+
+	var found []Detection
+	walkUpFrom(dir, func(current string) bool {
+		for _, backend := range candidates {
+			if detection, ok := backend.Detect(current); ok {
+				detection.Backend = backend
+				found = append(found, detection)
+			}
+		}
+		return len(found) > 0
+	})
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Confidence > found[j].Confidence
+	})
+
+	return found
+}
+
+// The repositories enclosing the one at root, innermost first
+func detectParentRepos(root string) []ParentRepo {
+	parents := []ParentRepo{}
+
+	for {
+		parent := filepath.Dir(root)
+		if parent == root {
+			return parents
+		}
+
+		found := detectRepos(parent, DetectBackend)
+		if len(found) == 0 {
+			return parents
+		}
+
+		root = found[0].Root
+		parents = append(parents, ParentRepo{VCS: found[0].Backend.Name(), RepoPath: root})
+	}
+}
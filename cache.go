@@ -0,0 +1,252 @@
+package main
+
+/**
+ * Daemon response cache: RepoInfo per repository root, dropped when the filesystem changes
+ */
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+type repoCacheKey struct {
+	Root       string
+	Vcs        string
+	ForceColor bool
+	Remote     bool
+	Parents    bool
+}
+
+type repoCacheEntry struct {
+	key    repoCacheKey
+	info   *RepoInfo
+	loaded time.Time
+
+	// The request info was loaded for, to load it again in the background
+	req Request
+
+	// Changed since it was loaded (only kept when serving stale results), and whether it's being reloaded
+	stale      bool
+	refreshing bool
+}
+
+type RepoCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[repoCacheKey]*list.Element
+	lru     *list.List
+	watcher *RepoWatcher
+
+	// Answer with stale results while they're reloaded in the background, instead of dropping them
+	serveStale bool
+
+	// Bumped whenever a root changes, so loads that raced a change aren't stored
+	generations    map[string]uint64
+	nextGeneration uint64
+
+	// Bumped when everything is dropped at once
+	epoch uint64
+}
+
+// Returns nil (no caching) if size is zero or we can't watch for changes
+func NewRepoCache(size int, serveStale bool) *RepoCache {
+	if size <= 0 {
+		return nil
+	}
+
+	cache := &RepoCache{
+		size:        size,
+		entries:     map[repoCacheKey]*list.Element{},
+		lru:         list.New(),
+		generations: map[string]uint64{},
+		serveStale:  serveStale,
+	}
+
+	watcher, err := NewRepoWatcher(cache.invalidate)
+	if err != nil {
+		log.Printf("Caching disabled: %s", err)
+		return nil
+	}
+	cache.watcher = watcher
+
+	return cache
+}
+
+// Load repository information, from the cache if nothing has changed since it was stored (or if it has, when
+// serving stale results)
+func (c *RepoCache) Load(req Request, r *Renderer) *RepoInfo {
+	if c == nil {
+		return activeRepoLoader.Load(req, r)
+	}
+
+	root, extraDirs := findCacheRoot(req)
+	if root == "" {
+		return activeRepoLoader.run(req, r)
+	}
+
+	key := newRepoCacheKey(root, req)
+
+	c.mutex.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		entry := element.Value.(*repoCacheEntry)
+		if entry.stale && !entry.refreshing {
+			entry.refreshing = true
+			go c.refresh(entry, c.generations[root], c.epoch)
+		}
+		info := c.responseLocked(entry)
+		c.mutex.Unlock()
+		return info
+	}
+	generation := c.generations[root]
+	epoch := c.epoch
+	c.mutex.Unlock()
+
+	// Watch before loading, so changes made while we load invalidate the result
+	if err := c.watcher.Watch(root, extraDirs...); err != nil {
+		log.Printf("Not caching '%s': %s", root, err)
+		return activeRepoLoader.loadShared(key, req, r)
+	}
+
+	info := activeRepoLoader.loadShared(key, req, r)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Nothing to store: try again next time rather than keep serving an incomplete answer, or one that
+	// raced a change
+	if info == nil || info.TimedOut || c.generations[root] != generation || c.epoch != epoch {
+		c.releaseLocked(root)
+		return info
+	}
+
+	// Requests that shared a load all get here with the same result
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		return c.responseLocked(element.Value.(*repoCacheEntry))
+	}
+
+	entry := &repoCacheEntry{key: key, info: info, loaded: time.Now(), req: req}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		c.evictLocked(c.lru.Back())
+	}
+
+	return c.responseLocked(entry)
+}
+
+// Reload a stale entry, leaving it stale if the repository changed again meanwhile
+func (c *RepoCache) refresh(entry *repoCacheEntry, generation uint64, epoch uint64) {
+	info := activeRepoLoader.loadShared(entry.key, entry.req, NewRenderer(entry.key.ForceColor))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry.refreshing = false
+
+	if info == nil || info.TimedOut || c.generations[entry.key.Root] != generation || c.epoch != epoch {
+		return
+	}
+
+	entry.info = info
+	entry.loaded = time.Now()
+	entry.stale = false
+}
+
+// When serving stale results, every response says how old it is
+func (c *RepoCache) responseLocked(entry *repoCacheEntry) *RepoInfo {
+	if !c.serveStale {
+		return entry.info
+	}
+
+	// Cached infos are shared between requests, so mark a copy
+	info := *entry.info
+	info.Stale = entry.stale
+	info.AgeSeconds = time.Since(entry.loaded).Seconds()
+
+	return &info
+}
+
+// Drop everything, e.g. when the configuration changes
+func (c *RepoCache) Clear() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.epoch++
+	roots := map[string]bool{}
+	for key := range c.entries {
+		roots[key.Root] = true
+	}
+	c.entries = map[repoCacheKey]*list.Element{}
+	c.lru.Init()
+
+	for root := range roots {
+		c.releaseLocked(root)
+	}
+}
+
+func (c *RepoCache) invalidate(root string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextGeneration++
+	c.generations[root] = c.nextGeneration
+
+	for key, element := range c.entries {
+		if key.Root != root {
+			continue
+		}
+
+		if c.serveStale {
+			element.Value.(*repoCacheEntry).stale = true
+		} else {
+			c.lru.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+
+	c.releaseLocked(root)
+}
+
+func (c *RepoCache) evictLocked(element *list.Element) {
+	entry := element.Value.(*repoCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+
+	c.releaseLocked(entry.key.Root)
+}
+
+// Stop watching root once nothing cached refers to it
+func (c *RepoCache) releaseLocked(root string) {
+	for key := range c.entries {
+		if key.Root == root {
+			return
+		}
+	}
+	c.watcher.Unwatch(root)
+
+	// Loads still in flight for this root can't be trusted without the watch
+	c.nextGeneration++
+	c.generations[root] = c.nextGeneration
+}
+
+// Requests with the same key get the same RepoInfo
+func newRepoCacheKey(root string, req Request) repoCacheKey {
+	return repoCacheKey{Root: root, Vcs: req.Vcs, ForceColor: req.ForceColor, Remote: req.Remote, Parents: req.Parents}
+}
+
+// The root loadRepo will report for a request, plus directories outside it that affect the status
+func findCacheRoot(req Request) (string, []string) {
+	found := detectRepos(req.Directory, req.Vcs)
+	if len(found) == 0 {
+		return "", nil
+	}
+	return found[0].Root, found[0].ExtraDirs
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cachedEntries(c *RepoCache) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+func watchedRoots(c *RepoCache) int {
+	c.watcher.mutex.Lock()
+	defer c.watcher.mutex.Unlock()
+	return len(c.watcher.roots)
+}
+
+// Load dir until it's cached; git may touch the repository while loading, which throws the result away
+func loadIntoCache(t *testing.T, c *RepoCache, dir string, entries int) {
+	t.Helper()
+
+	for try := 0; try < 10; try++ {
+		c.Load(Request{Directory: dir, Vcs: "git"}, NewRenderer(false))
+		if cachedEntries(c) == entries {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("'%s' never stayed cached", dir)
+}
+
+func waitForWatchedRoots(t *testing.T, c *RepoCache, roots int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for watchedRoots(c) != roots {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watching %d roots, expected %d", watchedRoots(c), roots)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRepoCacheReleasesWatches(t *testing.T) {
+	first := newTestGitRepo(t)
+	second := newTestGitRepo(t)
+
+	t.Run("invalidate", func(t *testing.T) {
+		c := NewRepoCache(4, false)
+		loadIntoCache(t, c, first, 1)
+		waitForWatchedRoots(t, c, 1)
+
+		if err := os.WriteFile(filepath.Join(first, "changed"), []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForWatchedRoots(t, c, 0)
+		if entries := cachedEntries(c); entries != 0 {
+			t.Errorf("%d entries left after a change", entries)
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		c := NewRepoCache(1, false)
+		loadIntoCache(t, c, first, 1)
+		loadIntoCache(t, c, second, 1)
+		waitForWatchedRoots(t, c, 1)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		c := NewRepoCache(4, false)
+		loadIntoCache(t, c, first, 1)
+		loadIntoCache(t, c, second, 2)
+		c.Clear()
+		waitForWatchedRoots(t, c, 0)
+	})
+}
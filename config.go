@@ -0,0 +1,251 @@
+package main
+
+/**
+ * User configuration: status symbols, colors and ordering, and main branch names
+ *
+ * Read from $XDG_CONFIG_HOME/vcsstatus/config (or --config) as JSON, e.g.:
+ *
+ *   {
+ *     "main_branches": ["main", "master", "trunk"],
+ *     "colors": {"branch_clean": "higreen", "vcs_main": "bold"},
+ *     "vcs": {
+ *       "git": {
+ *         "order": ["M", "A", "D", "?"],
+ *         "hide": ["?"],
+ *         "codes": {"M": {"symbol": "*", "color": "yellow"}}
+ *       }
+ *     }
+ *   }
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+var DefaultMainBranches = []string{"master", "mainline"}
+
+// Colors for everything other than status codes
+var DefaultColors = map[string]color.Attribute{
+	"vcs":              color.FgHiCyan,
+	"vcs_main":         color.FgHiGreen,
+	"branch_clean":     color.FgGreen,
+	"branch_merging":   color.FgHiMagenta,
+	"branch_untracked": color.FgHiRed,
+	"branch_unstaged":  color.FgHiYellow,
+	"branch_staged":    color.FgYellow,
+	"branch_ahead":     color.FgMagenta,
+	"other_branch":     color.FgWhite,
+	"bookmark":         color.FgCyan,
+	"worktree_branch":  color.FgCyan,
+}
+
+type StatusCodeConfig struct {
+	Symbol string `json:"symbol"`
+	Color  string `json:"color"`
+}
+
+type VCSConfig struct {
+	Order []string                    `json:"order"`
+	Hide  []string                    `json:"hide"`
+	Codes map[string]StatusCodeConfig `json:"codes"`
+}
+
+type ConfigFile struct {
+	MainBranches []string             `json:"main_branches"`
+	Colors       map[string]string    `json:"colors"`
+	VCS          map[string]VCSConfig `json:"vcs"`
+}
+
+// The configuration in effect; never modified once built, so it can be shared between requests
+type Config struct {
+	MainBranches []string
+	Colors       map[string]color.Attribute
+	StatusFields map[string]RepoChangeStatusVCSFields
+}
+
+var activeConfig atomic.Value
+var defaultConfigOnce sync.Once
+
+// The defaults until a file is loaded; built on first use, once every backend has registered
+func currentConfig() *Config {
+	defaultConfigOnce.Do(func() {
+		if activeConfig.Load() == nil {
+			config, _ := buildConfig(ConfigFile{})
+			activeConfig.Store(config)
+		}
+	})
+	return activeConfig.Load().(*Config)
+}
+
+func (c *Config) Fields(vcs string) RepoChangeStatusVCSFields {
+	return c.StatusFields[vcs]
+}
+
+func (c *Config) Color(name string) color.Attribute {
+	return c.Colors[name]
+}
+
+// Main branch names can be globs, like "release/*"
+func (c *Config) IsMainBranch(branch string) bool {
+	for _, pattern := range c.MainBranches {
+		if matched, err := path.Match(pattern, branch); pattern == branch || (err == nil && matched) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultConfigPath() string {
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(xdg, "vcsstatus", "config")
+}
+
+// Load and activate a config file; a missing file means the defaults
+func loadConfig(path string) error {
+	var file ConfigFile
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(contents, &file); err != nil {
+			return fmt.Errorf("error parsing '%s': %s", path, err)
+		}
+	}
+
+	config, err := buildConfig(file)
+	if err != nil {
+		return fmt.Errorf("error in '%s': %s", path, err)
+	}
+
+	activeConfig.Store(config)
+	return nil
+}
+
+// Apply a config file's overrides on top of the built in definitions
+func buildConfig(file ConfigFile) (*Config, error) {
+	config := &Config{
+		MainBranches: DefaultMainBranches,
+		Colors:       map[string]color.Attribute{},
+		StatusFields: map[string]RepoChangeStatusVCSFields{},
+	}
+
+	if file.MainBranches != nil {
+		config.MainBranches = file.MainBranches
+	}
+
+	for name, attribute := range DefaultColors {
+		config.Colors[name] = attribute
+	}
+	for name, value := range file.Colors {
+		if _, ok := DefaultColors[name]; !ok {
+			return nil, fmt.Errorf("unknown color setting '%s'", name)
+		}
+		attribute, ok := colorAttributeByName(value)
+		if !ok {
+			return nil, fmt.Errorf("unknown color '%s'", value)
+		}
+		config.Colors[name] = attribute
+	}
+
+	for name, defaults := range RepoChangeStatusFieldDefinitions {
+		fields := RepoChangeStatusVCSFields{
+			VCS:         defaults.VCS,
+			OrderedKeys: append([]rune{}, defaults.OrderedKeys...),
+			StatusCodes: make(map[rune]RepoChangeStatus, len(defaults.StatusCodes)),
+		}
+		for key, code := range defaults.StatusCodes {
+			fields.StatusCodes[key] = code
+		}
+
+		if overrides, ok := file.VCS[name]; ok {
+			if err := applyVCSConfig(&fields, overrides); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+
+		config.StatusFields[name] = fields
+	}
+
+	for name := range file.VCS {
+		if _, ok := RepoChangeStatusFieldDefinitions[name]; !ok {
+			return nil, fmt.Errorf("unknown vcs '%s'", name)
+		}
+	}
+
+	return config, nil
+}
+
+func applyVCSConfig(fields *RepoChangeStatusVCSFields, overrides VCSConfig) error {
+	for code, override := range overrides.Codes {
+		key, err := statusCodeKey(code, fields)
+		if err != nil {
+			return err
+		}
+
+		status := fields.StatusCodes[key]
+		if override.Symbol != "" {
+			status.OutputCharacter, _ = utf8.DecodeRuneInString(override.Symbol)
+		}
+		if override.Color != "" {
+			attribute, ok := colorAttributeByName(override.Color)
+			if !ok {
+				return fmt.Errorf("unknown color '%s'", override.Color)
+			}
+			status.OutputColor = attribute
+		}
+		fields.StatusCodes[key] = status
+	}
+
+	if overrides.Order != nil {
+		fields.OrderedKeys = []rune{}
+		for _, code := range overrides.Order {
+			key, err := statusCodeKey(code, fields)
+			if err != nil {
+				return err
+			}
+			fields.OrderedKeys = append(fields.OrderedKeys, key)
+		}
+	}
+
+	for _, code := range overrides.Hide {
+		key, err := statusCodeKey(code, fields)
+		if err != nil {
+			return err
+		}
+		shown := []rune{}
+		for _, ordered := range fields.OrderedKeys {
+			if ordered != key {
+				shown = append(shown, ordered)
+			}
+		}
+		fields.OrderedKeys = shown
+	}
+
+	return nil
+}
+
+func statusCodeKey(code string, fields *RepoChangeStatusVCSFields) (rune, error) {
+	key, size := utf8.DecodeRuneInString(code)
+	if size == 0 || size != len(code) {
+		return 0, fmt.Errorf("status codes are single characters, not '%s'", code)
+	}
+	if _, ok := fields.StatusCodes[key]; !ok {
+		return 0, fmt.Errorf("unknown status code '%s'", code)
+	}
+	return key, nil
+}
@@ -46,7 +46,7 @@ func writeResponse(connection net.Conn, response Response) {
 	}
 }
 
-func handleConnection(connection net.Conn) {
+func handleConnection(connection net.Conn, cache *RepoCache) {
 	//noinspection GoUnhandledErrorResult
 	defer connection.Close()
 
@@ -66,16 +66,46 @@ func handleConnection(connection net.Conn) {
 	}
 
 	// Load repo
-	repo := loadRepo(req)
+	r := NewRenderer(req.ForceColor)
+	repo := cache.Load(req, r)
 
 	// Build response
-	response := buildResponse(req, repo)
+	response := buildResponse(req, repo, r)
 	writeResponse(connection, response)
 }
 
 func daemonMain(options ExecutionOptions) {
 	cleanUpExistingSocket(options)
 
+	if err := loadConfig(options.ConfigPath); err != nil {
+		log.Printf("Using default configuration: %s", err)
+	}
+
+	activeRepoLoader = NewRepoLoader(options.Workers)
+	cache := NewRepoCache(options.CacheSize, options.ServeStale)
+
+	if options.RemoteRefresh > 0 {
+		activeHgRemoteTracker = NewHgRemoteTracker(options.RemoteRefresh, func(root string) {
+			if cache != nil {
+				cache.invalidate(root)
+			}
+		})
+	}
+
+	// Reload configuration on SIGHUP
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Printf("Reloading configuration from '%s'", options.ConfigPath)
+			if err := loadConfig(options.ConfigPath); err != nil {
+				log.Printf("Keeping previous configuration: %s", err)
+				continue
+			}
+			cache.Clear()
+		}
+	}()
+
 	// Handle shutdown better
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -120,7 +150,7 @@ func daemonMain(options ExecutionOptions) {
 			continue
 		}
 
-		go handleConnection(connection)
+		go handleConnection(connection, cache)
 	}
 }
 
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A git repository with an untracked file, so prompt output has colored branch and status parts
+func newTestGitRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s: %s", err, output)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "untracked"), []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// Send req to handleConnection over a pipe, as the client does
+func requestFromDaemon(t *testing.T, req Request, cache *RepoCache) Response {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go handleConnection(server, cache)
+
+	if err := json.NewEncoder(client).Encode(req); err != nil {
+		t.Errorf("Error encoding request: %s", err)
+		return Response{}
+	}
+
+	var response Response
+	if err := json.NewDecoder(client).Decode(&response); err != nil {
+		t.Errorf("Error decoding response: %s", err)
+	}
+	return response
+}
+
+func TestDaemonConcurrentColoring(t *testing.T) {
+	dir := newTestGitRepo(t)
+
+	caches := map[string]*RepoCache{
+		"uncached": nil,
+		"cached":   NewRepoCache(4, false),
+	}
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 40; i++ {
+				wg.Add(1)
+				go func(forceColor bool) {
+					defer wg.Done()
+
+					response := requestFromDaemon(t, Request{ForceColor: forceColor, Directory: dir, Output: Prompt, Vcs: "git"}, cache)
+					if response.ExitCode != 0 {
+						t.Errorf("Exit code %d: %q", response.ExitCode, response.Content)
+						return
+					}
+
+					if colored := strings.Contains(response.Content, "\x1b["); colored != forceColor {
+						t.Errorf("Requested color %v, got escapes %v: %q", forceColor, colored, response.Content)
+					}
+				}(i%2 == 0)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestRequestDecodesVcs(t *testing.T) {
+	tests := []struct {
+		json string
+		vcs  string
+	}{
+		{`{"Directory": "/"}`, ""},
+		{`{"Directory": "/", "Vcs": "hg"}`, "hg"},
+		{`{"Directory": "/", "Vcs": 0}`, DetectBackend},
+		{`{"Directory": "/", "Vcs": 3}`, "gitnative"},
+		{`{"Directory": "/", "Vcs": 6}`, "fossil"},
+	}
+
+	for _, test := range tests {
+		var req Request
+		if err := json.Unmarshal([]byte(test.json), &req); err != nil {
+			t.Errorf("%s: %s", test.json, err)
+			continue
+		}
+		if req.Vcs != test.vcs || req.Directory != "/" {
+			t.Errorf("%s: got vcs %q, directory %q", test.json, req.Vcs, req.Directory)
+		}
+	}
+
+	var req Request
+	if err := json.Unmarshal([]byte(`{"Vcs": 7}`), &req); err == nil {
+		t.Errorf("Unknown vcs number accepted")
+	}
+}
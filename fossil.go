@@ -0,0 +1,197 @@
+package main
+
+/**
+ * Fossil Repo Information
+ */
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type fossilBackend struct{}
+
+func init() {
+	registerBackend(fossilBackend{}, RepoChangeStatusVCSFields{VCS: "fossil", StatusCodes: FossilRepoChangeStatusFieldDefinitions,
+		OrderedKeys: []rune{'M', 'A', 'D', 'R', 'C', '!', '?'}})
+}
+
+func (fossilBackend) Name() string {
+	return "fossil"
+}
+
+func (fossilBackend) Detect(dir string) (Detection, bool) {
+	return Detection{Root: dir, Confidence: 1}, isFossilCheckout(dir)
+}
+
+func (fossilBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	return NewFossilRepoInfo(ctx, &req.Directory, r)
+}
+
+type FossilInfo struct {
+	Checkout   string   `json:"checkout"`
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+}
+
+// What `fossil changes --differ` prints for each file, and the status code we count it as
+var fossilChangeCodes = map[string]rune{
+	"EDITED":               'M',
+	"UPDATED_BY_MERGE":     'M',
+	"UPDATED_BY_INTEGRATE": 'M',
+	"ADDED":                'A',
+	"ADDED_BY_MERGE":       'A',
+	"ADDED_BY_INTEGRATE":   'A',
+	"DELETED":              'D',
+	"RENAMED":              'R',
+	"CONFLICT":             'C',
+	"MISSING":              '!',
+	"EXTRA":                '?',
+}
+
+func NewFossilRepoInfo(ctx context.Context, workingDirectory *string, r *Renderer) *RepoInfo {
+	config := currentConfig()
+	codes := config.Fields("fossil")
+
+	root, found := findFossilCheckout(*workingDirectory)
+	if !found {
+		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
+	}
+
+	output, exitCode, err := execAndGetOutputContext(ctx, "fossil", workingDirectory, "info")
+	if ctx.Err() != nil {
+		return newTimedOutRepoInfo(codes.VCS, root, r)
+	} else if err != nil || exitCode != 0 {
+		return nil
+	}
+
+	vcscolor := config.Color("vcs")
+
+	fossil := &FossilInfo{Tags: []string{}}
+	for _, line := range strings.Split(output, "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch line[:colon] {
+		case "checkout":
+			// "<hash> <date> <time> UTC"
+			fossil.Checkout = strings.Fields(value + " ")[0]
+		case "repository":
+			fossil.Repository = value
+		case "tags":
+			for _, tag := range strings.Split(value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					fossil.Tags = append(fossil.Tags, tag)
+				}
+			}
+		}
+	}
+
+	info := &RepoInfo{
+		IsRepo:   true,
+		VCS:      AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)},
+		VCSColor: vcscolor,
+		RepoPath: root,
+		RepoName: path.Base(root),
+		Fossil:   fossil,
+	}
+
+	// Per-file status
+	status := make(map[rune]int, len(codes.StatusCodes))
+	for field := range codes.StatusCodes {
+		status[field] = 0
+	}
+
+	output, _, _ = execAndGetOutputContext(ctx, "fossil", workingDirectory, "changes", "--differ")
+	timedOut := ctx.Err() != nil
+
+	info.Files = []RepoFileStatus{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if fields[0] == "MERGED_WITH" || fields[0] == "INTEGRATE" {
+			info.Operation = &RepoOperation{Name: "merging"}
+			continue
+		}
+
+		code, ok := fossilChangeCodes[fields[0]]
+		if !ok {
+			continue
+		}
+
+		status[code]++
+		file := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		info.Files = append(info.Files, RepoFileStatus{Path: file, Code: string(code)})
+	}
+
+	// Figure out branch status
+	branchColor := config.Color("branch_clean")
+	if info.Operation != nil || status['C'] > 0 {
+		branchColor = config.Color("branch_merging")
+	} else if status['?'] > 0 {
+		branchColor = config.Color("branch_untracked")
+	} else if len(info.Files) > 0 {
+		branchColor = config.Color("branch_unstaged")
+	}
+
+	branch := ""
+	output, exitCode, err = execAndGetOutputContext(ctx, "fossil", workingDirectory, "branch", "current")
+	if err == nil && exitCode == 0 {
+		branch = strings.TrimSpace(output)
+	}
+	if branch == "" && len(fossil.Tags) > 0 {
+		// Older fossils lack "branch current"; the branch is a tag too
+		branch = fossil.Tags[0]
+	}
+	if branch == "" {
+		branch = "!branch!"
+	}
+
+	info.BranchName = AnsiString{Plain: branch, Colored: r.Sprint(branchColor, branch)}
+	info.IsDefaultBranch = branch == "trunk" || config.IsMainBranch(branch)
+	if info.IsDefaultBranch {
+		info.VCSColor = config.Color("vcs_main")
+		info.VCS.Colored = r.Sprint(info.VCSColor, info.VCS.Plain)
+	}
+
+	// Other open branches; the current one is marked with "*"
+	info.OtherBranches = []AnsiString{}
+	output, _, _ = execAndGetOutputContext(ctx, "fossil", workingDirectory, "branch", "list")
+	for _, line := range strings.Split(output, "\n") {
+		other := strings.TrimSpace(line)
+		if other == "" || strings.HasPrefix(other, "*") || other == branch {
+			continue
+		}
+		info.OtherBranches = append(info.OtherBranches, AnsiString{Plain: other, Colored: r.Sprint(config.Color("other_branch"), other)})
+	}
+
+	info.BranchTrackingInfo = buildTrackingInfo(branch, "", 0, 0, false, r)
+
+	info.ChangeStatusCounts = status
+	colorStatus := buildColoredStatusStringFromMap(status, &codes, r)
+
+	info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
+
+	if timedOut {
+		markTimedOut(info, r)
+	}
+
+	return info
+}
+
+func findFossilCheckout(dir string) (string, bool) {
+	return walkUpFrom(dir, isFossilCheckout)
+}
+
+// Checkouts have a .fslckout database at their root (_FOSSIL_ on Windows and older versions)
+func isFossilCheckout(dir string) bool {
+	return fileExists(filepath.Join(dir, ".fslckout")) || fileExists(filepath.Join(dir, "_FOSSIL_"))
+}
@@ -5,23 +5,53 @@ package main
  */
 
 import (
+	"context"
 	"github.com/fatih/color"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
-func NewGitRepoInfo(workingDirectory *string) *RepoInfo {
-	codes := RepoChangeStatusFieldDefinitions["git"]
+// Runs `git status`
+type gitBackend struct{}
 
-	// TODO: Make this not run a command to get this data
-	// Go do a git status in that folder
-	output, exitCode, err := execAndGetOutput("git", workingDirectory,
-		"-c", "color.status=never", "-c", "color.ui=never", "status")
+var gitStatusFields = RepoChangeStatusVCSFields{VCS: "git", StatusCodes: GitRepoChangeStatusFieldDefinitions,
+	OrderedKeys: []rune{'M', 'A', 'D', 'R', 'C', 'U', '?', '!', '$'}}
 
-	if err != nil {
+func init() {
+	registerBackend(gitBackend{}, gitStatusFields)
+}
+
+func (gitBackend) Name() string {
+	return "git"
+}
+
+func (gitBackend) Detect(dir string) (Detection, bool) {
+	return detectGitRepo(dir, 1)
+}
+
+func (gitBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	return NewGitRepoInfo(ctx, &req.Directory, r)
+}
+
+func NewGitRepoInfo(ctx context.Context, workingDirectory *string, r *Renderer) *RepoInfo {
+	codes := currentConfig().Fields("git")
+
+	// Go do a git status in that folder (NewNativeGitRepoInfo avoids running a command at all)
+	output, exitCode, err := execAndGetOutputContext(ctx, "git", workingDirectory,
+		"--no-optional-locks", "status", "--porcelain=v2", "--branch", "-z")
+
+	if ctx.Err() != nil {
+		// Out of time: report what HEAD says, without file status
+		return newTimedOutGitRepoInfo(workingDirectory, r)
+	} else if err != nil && exitCode != 128 {
 		// Some kind of command execution error!
 		return nil
 	} else if exitCode == 128 {
+		// Bare repositories and .git directories have no worktree to get the status of
+		if gitDir, ok := findEnclosingGitDir(*workingDirectory); ok {
+			return newGitDirRepoInfo(gitDir, r)
+		}
 		// Not a git repo
 		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
 	} else if exitCode != 0 {
@@ -29,116 +59,195 @@ func NewGitRepoInfo(workingDirectory *string) *RepoInfo {
 		return nil
 	}
 
-	vcscolor := color.New(color.FgHiCyan)
+	info, gitDir, found := newGitRepoInfo(workingDirectory, r)
 
-	info := &RepoInfo{IsRepo: true, VCS: AnsiString{Plain: codes.VCS, Colored: vcscolor.Sprint(codes.VCS)}, VCSColor: vcscolor}
+	parsed, err := parseGitPorcelainV2(output)
+	if err != nil {
+		branch := "!branch!"
+		info.BranchName = AnsiString{Plain: branch, Colored: r.Sprint(color.FgGreen, branch)}
+		info.OtherBranches = []AnsiString{}
+		status := "!status!"
+		info.Status = AnsiString{Plain: status, Colored: r.Sprint(color.FgHiRed, status)}
+		return info
+	}
 
-	// Figure out branch status TODO: This could be optimized I bet
-	branchColor := color.New(color.FgGreen)
+	fillGitRepoInfo(info, gitDir, found, parsed, r)
 
-	if strings.Contains(output, "still merging") || strings.Contains(output, "Unmerged paths") {
-		branchColor = color.New(color.FgHiMagenta)
-	} else if strings.Contains(output, "Untracked files") {
-		branchColor = color.New(color.FgHiRed)
-	} else if strings.Contains(output, "Changes not staged for commit") {
-		branchColor = color.New(color.FgHiYellow)
-	} else if strings.Contains(output, "Changes to be committed") {
-		branchColor = color.New(color.FgYellow)
-	} else if strings.Contains(output, "Your branch is ahead of") {
-		branchColor = color.New(color.FgMagenta)
+	return info
+}
+
+// Branch information read straight from .git, for when git status didn't finish in time
+func newTimedOutGitRepoInfo(workingDirectory *string, r *Renderer) *RepoInfo {
+	info, gitDir, found := newGitRepoInfo(workingDirectory, r)
+	if !found {
+		codes := currentConfig().Fields("git")
+		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
 	}
 
+	parsed, err := readGitHeadStatus(gitDir)
+	if err != nil {
+		info.OtherBranches = []AnsiString{}
+		markTimedOut(info, r)
+		return info
+	}
+
+	fillGitRepoInfo(info, gitDir, found, parsed, r)
+	markTimedOut(info, r)
+
+	return info
+}
+
+// A RepoInfo for a git repository, with only the repository location filled in
+func newGitRepoInfo(workingDirectory *string, r *Renderer) (info *RepoInfo, gitDir string, found bool) {
+	config := currentConfig()
+	codes := config.Fields("git")
+
+	vcscolor := config.Color("vcs")
+
+	info = &RepoInfo{IsRepo: true, VCS: AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)}, VCSColor: vcscolor}
+
 	// Get repo name
-	output, exitCode, err = execAndGetOutput("git", workingDirectory,
-		"rev-parse", "--show-toplevel")
-	if err == nil {
-		info.RepoPath = strings.TrimSpace(output)
+	root, gitDir, found := findGitRoot(*workingDirectory)
+	if found {
+		info.RepoPath = root
 		info.RepoName = path.Base(info.RepoPath)
 	} else {
 		info.RepoName = "unknown"
 		info.RepoPath = *workingDirectory
 	}
 
-	// Figure out branches
-	output, _, err = execAndGetOutput("git", workingDirectory,
-		"-c", "color.status=never", "-c", "color.ui=never", "branch")
-
-	if err == nil {
-		lines := strings.Split(output, "\n")
+	return
+}
 
-		info.OtherBranches = []AnsiString{}
+// Fill in branch and status information from a parsed (or natively computed) status
+func fillGitRepoInfo(info *RepoInfo, gitDir string, found bool, parsed *GitPorcelainStatus, r *Renderer) {
+	config := currentConfig()
+	codes := config.Fields("git")
 
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-
-			if len(line) > 0 {
-				if strings.HasPrefix(line, "* ") {
-					branch := strings.TrimPrefix(line, "* ")
-					info.BranchName = AnsiString{Plain: branch, Colored: branchColor.Sprint(branch)}
-
-					// Update the git color if this is the master branch
-					if branch == "master" || branch == "mainline" {
-						info.VCSColor = color.New(color.FgHiGreen)
-						info.VCS.Colored = info.VCSColor.Sprint(info.VCS.Plain)
-					}
-				} else {
-					branch := strings.TrimSpace(line)
-					info.OtherBranches = append(info.OtherBranches, AnsiString{Plain: branch, Colored: color.WhiteString(branch)})
-				}
-			}
-		}
-	} else {
-		info.OtherBranches = []AnsiString{}
-		branch := "!branch!"
-		info.BranchName = AnsiString{Plain: branch, Colored: branchColor.Sprint(branch)}
+	if found {
+		info.Operation = readGitOperation(gitDir)
 	}
 
-	if err == nil {
-		// Get per-file status, as well as tracking info
+	// Figure out branch status
+	branchColor := config.Color("branch_clean")
+
+	if parsed.HasUnmerged || info.Operation != nil {
+		branchColor = config.Color("branch_merging")
+	} else if parsed.HasUntracked {
+		branchColor = config.Color("branch_untracked")
+	} else if parsed.HasUnstaged {
+		branchColor = config.Color("branch_unstaged")
+	} else if parsed.HasStaged {
+		branchColor = config.Color("branch_staged")
+	} else if parsed.Ahead > 0 {
+		branchColor = config.Color("branch_ahead")
+	}
 
-		status := make(map[rune]int, len(codes.StatusCodes))
-		for field := range codes.StatusCodes {
-			status[field] = 0
+	branch := parsed.BranchName()
+	if parsed.Detached {
+		if len(parsed.Oid) >= 7 {
+			info.DetachedCommit = parsed.Oid[:7]
 		}
+		// Mid-rebase, show the branch being rebased rather than the detached HEAD
+		if info.Operation != nil && info.Operation.Branch != "" {
+			branch = info.Operation.Branch
+		}
+	}
+	info.BranchName = AnsiString{Plain: branch, Colored: r.Sprint(branchColor, branch)}
 
-		output, _, err = execAndGetOutput("git", workingDirectory,
-			"-c", "color.status=always", "-c", "color.ui=always", "status", "-s", "-b")
-
-		lines := strings.Split(output, "\n")
+	// Update the git color if this is the master branch
+	info.IsDefaultBranch = info.DetachedCommit == "" && isGitDefaultBranch(branch, gitDir, found, config)
+	if info.IsDefaultBranch {
+		info.VCSColor = config.Color("vcs_main")
+		info.VCS.Colored = r.Sprint(info.VCSColor, info.VCS.Plain)
+	}
 
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
+	// Worktrees: linked ones are named after the main worktree, so they read as the same repository
+	checkedOut := map[string]bool{}
+	if found {
+		commonDir := gitCommonDir(gitDir)
+		info.MainWorktreePath = gitMainWorktree(commonDir, loadGitConfig(gitDir))
+		info.IsMainWorktree = filepath.Clean(gitDir) == commonDir
+		if !info.IsMainWorktree {
+			info.WorktreeName = filepath.Base(gitDir)
+			if info.MainWorktreePath != "" {
+				info.RepoName = path.Base(info.MainWorktreePath)
+			}
+		}
+		info.OtherWorktrees = listOtherGitWorktrees(gitDir, info.MainWorktreePath)
+		for _, worktree := range info.OtherWorktrees {
+			if worktree.Branch != "" {
+				checkedOut[worktree.Branch] = true
+			}
+		}
+	}
 
-			if len(line) < 2 {
+	// Figure out the other branches; like `git branch`, those checked out in other worktrees get a "+"
+	info.OtherBranches = []AnsiString{}
+	if found {
+		for _, other := range listGitBranches(gitCommonDir(gitDir)) {
+			if other == branch {
 				continue
 			}
-
-			// Grab first two characters
-			statchars := stripANSI(line)[:2]
-
-			if statchars == "##" {
-				// Branch status
-				tracking := line[3:]
-				info.BranchTrackingInfo = AnsiString{Plain: stripANSI(tracking), Colored: tracking}
+			if checkedOut[other] {
+				info.OtherBranches = append(info.OtherBranches, AnsiString{Plain: other, Colored: r.Sprint(config.Color("worktree_branch"), "+"+other)})
 			} else {
-				// File status
-				for key := range status {
-					if strings.ContainsRune(statchars, key) {
-						status[key]++
-					}
-				}
+				info.OtherBranches = append(info.OtherBranches, AnsiString{Plain: other, Colored: r.Sprint(config.Color("other_branch"), other)})
 			}
 		}
+	}
 
-		info.ChangeStatusCounts = status
-		colorStatus := buildColoredStatusStringFromMap(status, &codes)
+	// Tracking info and per-file status
+	info.BranchTrackingInfo = parsed.TrackingInfo(r)
+	info.Upstream = parsed.Upstream
+	info.Ahead = parsed.Ahead
+	info.Behind = parsed.Behind
+	info.UpstreamGone = parsed.Upstream != "" && !parsed.HasAheadBehind
+
+	info.Files = parsed.Files
+	if found {
+		if superRoot, ok := findGitSuperproject(info.RepoPath); ok {
+			info.SuperprojectPath = superRoot
+			info.SuperprojectName = path.Base(superRoot)
+		}
+		info.Submodules = summarizeGitSubmodules(info.RepoPath, parsed.Files)
+	}
+	info.ChangeStatusCounts = parsed.CountStatus(&codes)
+	if found {
+		info.StashCount, info.StashMessage = readGitStash(gitCommonDir(gitDir))
+		info.ChangeStatusCounts[StashStatusCode] = info.StashCount
+	}
+	colorStatus := buildColoredStatusStringFromMap(info.ChangeStatusCounts, &codes, r)
 
-		info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
+	info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
+}
 
-	} else {
-		status := "!status!"
-		info.Status = AnsiString{Plain: status, Colored: color.HiRedString(status)}
+// The configured main branches, init.defaultBranch, or what the remote's HEAD points at
+func isGitDefaultBranch(branch string, gitDir string, found bool, config *Config) bool {
+	if config.IsMainBranch(branch) {
+		return true
 	}
 
-	return info
+	if !found {
+		return false
+	}
+
+	gitConfig := loadGitConfig(gitDir)
+	if defaultBranch, ok := gitConfig.Get("init.defaultBranch"); ok && defaultBranch == branch {
+		return true
+	}
+
+	remotes := []string{"origin"}
+	if remote, ok := gitConfig.Get("branch." + branch + ".remote"); ok && remote != "origin" && remote != "." {
+		remotes = append(remotes, remote)
+	}
+
+	for _, remote := range remotes {
+		target, ok := readGitSymbolicRef(gitCommonDir(gitDir), "refs/remotes/"+remote+"/HEAD")
+		if ok && strings.TrimPrefix(target, "refs/remotes/"+remote+"/") == branch {
+			return true
+		}
+	}
+
+	return false
 }
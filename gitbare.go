@@ -0,0 +1,83 @@
+package main
+
+/**
+ * Bare repositories and git directories, where there's no worktree for `git status` to look at
+ */
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The same test git uses: a HEAD file plus objects and refs directories
+func isGitDirectory(dir string) bool {
+	return fileExists(filepath.Join(dir, "HEAD")) &&
+		fileExists(filepath.Join(dir, "objects")) &&
+		fileExists(filepath.Join(dir, "refs"))
+}
+
+// The git directory containing dir, when it's closer than any worktree root: inside a bare
+// repository, or inside a worktree's .git directory
+func findEnclosingGitDir(dir string) (string, bool) {
+	found, ok := walkUpFrom(dir, func(current string) bool {
+		return isGitDirectory(current) || fileExists(filepath.Join(current, ".git"))
+	})
+	if !ok || !isGitDirectory(found) {
+		return "", false
+	}
+	return found, true
+}
+
+// Branch and ref information for a git directory, with no worktree status
+func newGitDirRepoInfo(gitDir string, r *Renderer) *RepoInfo {
+	config := currentConfig()
+	codes := config.Fields("git")
+
+	vcscolor := config.Color("vcs")
+	gitConfig := loadGitConfig(gitDir)
+	bare := gitConfig.GetBool("core.bare", filepath.Base(gitDir) != ".git")
+
+	info := &RepoInfo{
+		IsRepo:   true,
+		VCS:      AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)},
+		VCSColor: vcscolor,
+		RepoPath: gitDir,
+		IsBare:   bare,
+		IsGitDir: !bare,
+	}
+
+	// "project.git" for bare repositories, the worktree's name for .git directories
+	if bare {
+		info.RepoName = strings.TrimSuffix(path.Base(gitDir), ".git")
+		if info.RepoName == "" {
+			info.RepoName = path.Base(gitDir)
+		}
+	} else {
+		info.RepoName = path.Base(path.Dir(gitDir))
+	}
+
+	parsed, err := readGitHeadStatus(gitDir)
+	if err != nil {
+		return nil
+	}
+
+	// Ahead/behind needs the object store; without it, leave out the upstream rather than call it gone
+	if !parsed.Detached {
+		store, err := openGitObjectStore(gitCommonDir(gitDir))
+		if err == nil {
+			if nativeGitUpstream(parsed, gitDir, gitConfig, store) != nil {
+				parsed.Upstream = ""
+			}
+			store.Close()
+		}
+	}
+
+	fillGitRepoInfo(info, gitDir, true, parsed, r)
+
+	if bare {
+		info.IsMainWorktree = false
+	}
+
+	return info
+}
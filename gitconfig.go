@@ -0,0 +1,219 @@
+package main
+
+/**
+ * Minimal git config file reader
+ */
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Keys are "section.name" or "section.subsection.name", with section and name lowercased
+type GitConfig map[string][]string
+
+// The last value set for a key
+func (c GitConfig) Get(key string) (string, bool) {
+	values := c[normalizeGitConfigKey(key)]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// Every value set for a multi-valued key, in order
+func (c GitConfig) GetAll(key string) []string {
+	return c[normalizeGitConfigKey(key)]
+}
+
+func (c GitConfig) GetBool(key string, def bool) bool {
+	value, ok := c.Get(key)
+	if !ok {
+		return def
+	}
+
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0", "":
+		return false
+	}
+	return def
+}
+
+func normalizeGitConfigKey(key string) string {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	if first == last {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+// Load the system, global and repository config files, in that order
+func loadGitConfig(gitDir string) GitConfig {
+	config := GitConfig{}
+
+	for _, file := range gitGlobalConfigPaths() {
+		_ = config.readFile(file, 0)
+	}
+
+	commonDir := gitCommonDir(gitDir)
+	_ = config.readFile(filepath.Join(commonDir, "config"), 0)
+
+	if config.GetBool("extensions.worktreeConfig", false) {
+		_ = config.readFile(filepath.Join(gitDir, "config.worktree"), 0)
+	}
+
+	return config
+}
+
+func gitGlobalConfigPaths() []string {
+	paths := []string{"/etc/gitconfig"}
+
+	if env := os.Getenv("GIT_CONFIG_GLOBAL"); env != "" {
+		return append(paths, env)
+	}
+
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	paths = append(paths, filepath.Join(xdg, "git", "config"))
+	paths = append(paths, filepath.Join(os.Getenv("HOME"), ".gitconfig"))
+
+	return paths
+}
+
+func (c GitConfig) readFile(path string, depth int) error {
+	// Guard against include loops
+	if depth > 10 {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Join continuation lines
+		for strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && scanner.Scan() {
+			line = line[:len(line)-1] + scanner.Text()
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			section = parseGitConfigSection(line[1:end])
+			line = strings.TrimSpace(line[end+1:])
+			if len(line) == 0 {
+				continue
+			}
+		}
+
+		var name, value string
+		if eq := strings.Index(line, "="); eq >= 0 {
+			name = strings.TrimSpace(line[:eq])
+			value = parseGitConfigValue(line[eq+1:])
+		} else {
+			// A bare key is a boolean true
+			name = strings.TrimSpace(line)
+			value = "true"
+		}
+
+		key := section + "." + strings.ToLower(name)
+		c[key] = append(c[key], value)
+
+		if key == "include.path" {
+			include := expandTilde(value)
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			_ = c.readFile(include, depth+1)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// [section "subsection"] keeps the subsection's case; [section.subsection] doesn't
+func parseGitConfigSection(header string) string {
+	header = strings.TrimSpace(header)
+
+	if quote := strings.Index(header, "\""); quote >= 0 {
+		name := strings.ToLower(strings.TrimSpace(header[:quote]))
+		sub := strings.TrimSuffix(header[quote+1:], "\"")
+		sub = strings.Replace(sub, "\\\"", "\"", -1)
+		sub = strings.Replace(sub, "\\\\", "\\", -1)
+		return name + "." + sub
+	}
+
+	return strings.ToLower(header)
+}
+
+func parseGitConfigValue(raw string) string {
+	var value strings.Builder
+	inQuotes := false
+	pendingSpace := ""
+
+	raw = strings.TrimSpace(raw)
+
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+
+		switch {
+		case ch == '"':
+			inQuotes = !inQuotes
+			continue
+		case !inQuotes && (ch == '#' || ch == ';'):
+			return value.String()
+		case ch == '\\' && i+1 < len(raw):
+			i++
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			default:
+				value.WriteByte(raw[i])
+			}
+			continue
+		case !inQuotes && (ch == ' ' || ch == '\t'):
+			// Only keep internal whitespace, each tab or space becoming a space
+			if value.Len() > 0 {
+				pendingSpace += " "
+			}
+			continue
+		}
+
+		value.WriteString(pendingSpace)
+		pendingSpace = ""
+		value.WriteByte(ch)
+	}
+
+	return value.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseGitConfigValue(t *testing.T) {
+	tests := []struct {
+		raw   string
+		value string
+	}{
+		{"plain", "plain"},
+		{"  padded  ", "padded"},
+		{"internal  spaces", "internal  spaces"},
+		{"tab\tinside", "tab inside"},
+		{"value # comment", "value"},
+		{"value ; comment", "value"},
+		{"value#comment", "value"},
+		{`"quoted # not a comment"`, "quoted # not a comment"},
+		{`"q;r" ; comment`, "q;r"},
+		{`"  kept  "`, "  kept  "},
+		{`half"quoted value"`, "halfquoted value"},
+		{`a\"b`, `a"b`},
+		{`back\\slash`, `back\slash`},
+		{`line\nbreak`, "line\nbreak"},
+		{`tab\tescape`, "tab\tescape"},
+		{`back\bspace`, "back\bspace"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if value := parseGitConfigValue(test.raw); value != test.value {
+			t.Errorf("%q: got %q, expected %q", test.raw, value, test.value)
+		}
+	}
+}
+
+func TestParseGitConfigSection(t *testing.T) {
+	tests := []struct {
+		header  string
+		section string
+	}{
+		{"Core", "core"},
+		{`remote "Origin"`, "remote.Origin"},
+		{`branch "with \"quote\""`, `branch.with "quote"`},
+		{"Branch.Main", "branch.main"},
+	}
+
+	for _, test := range tests {
+		if section := parseGitConfigSection(test.header); section != test.section {
+			t.Errorf("%q: got %q, expected %q", test.header, section, test.section)
+		}
+	}
+}
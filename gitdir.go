@@ -0,0 +1,235 @@
+package main
+
+/**
+ * Helpers for finding and reading a .git directory without running git
+ */
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Walk up from dir looking for a .git entry, returning the worktree root and the git directory
+func findGitRoot(dir string) (root string, gitDir string, ok bool) {
+	root, ok = walkUpFrom(dir, func(current string) bool {
+		resolved, err := resolveGitDir(filepath.Join(current, ".git"))
+		if err != nil {
+			return false
+		}
+		gitDir = resolved
+		return true
+	})
+
+	return
+}
+
+// A repository rooted at dir, watching its git directory too when that lives elsewhere
+func detectGitRepo(dir string, confidence int) (Detection, bool) {
+	if isGitDirectory(dir) {
+		// A bare repository, or a .git directory we're inside of
+		return Detection{Root: dir, Confidence: confidence}, true
+	}
+
+	gitDir, err := resolveGitDir(filepath.Join(dir, ".git"))
+	if err != nil {
+		return Detection{}, false
+	}
+
+	detection := Detection{Root: dir, Confidence: confidence}
+	if filepath.Dir(gitDir) != dir {
+		// Linked worktrees and submodules keep their git directory elsewhere
+		detection.ExtraDirs = append(detection.ExtraDirs, gitDir)
+		if commonDir := gitCommonDir(gitDir); commonDir != gitDir {
+			detection.ExtraDirs = append(detection.ExtraDirs, commonDir)
+		}
+	}
+
+	return detection, true
+}
+
+// A .git entry is either the git directory itself, or a file containing "gitdir: <path>"
+func resolveGitDir(dotGit string) (string, error) {
+	stat, err := os.Stat(dotGit)
+	if err != nil {
+		return "", err
+	}
+
+	if stat.IsDir() {
+		return dotGit, nil
+	}
+
+	contents, err := ioutil.ReadFile(dotGit)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(contents))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", os.ErrNotExist
+	}
+
+	gitDir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(dotGit), gitDir)
+	}
+
+	return filepath.Clean(gitDir), nil
+}
+
+// Linked worktrees keep shared refs in the directory named by their "commondir" file
+func gitCommonDir(gitDir string) string {
+	contents, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+
+	common := strings.TrimSpace(string(contents))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitDir, common)
+	}
+
+	return filepath.Clean(common)
+}
+
+// Local branch names, sorted, from both loose refs and packed-refs
+func listGitBranches(commonDir string) []string {
+	seen := map[string]bool{}
+
+	headsDir := filepath.Join(commonDir, "refs", "heads")
+	_ = filepath.Walk(headsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		name, err := filepath.Rel(headsDir, path)
+		if err == nil {
+			seen[filepath.ToSlash(name)] = true
+		}
+		return nil
+	})
+
+	for ref := range readPackedRefs(commonDir) {
+		if strings.HasPrefix(ref, "refs/heads/") {
+			seen[strings.TrimPrefix(ref, "refs/heads/")] = true
+		}
+	}
+
+	branches := make([]string, 0, len(seen))
+	for name := range seen {
+		branches = append(branches, name)
+	}
+	sort.Strings(branches)
+
+	return branches
+}
+
+// Map of ref name to object id from the packed-refs file
+func readPackedRefs(commonDir string) map[string]string {
+	refs := map[string]string{}
+
+	file, err := os.Open(filepath.Join(commonDir, "packed-refs"))
+	if err != nil {
+		return refs
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Skip the header and peeled tag lines
+		if len(line) == 0 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	return refs
+}
+
+// What HEAD points at: the symbolic ref (if any) and the object id (if it resolves)
+func readGitHead(gitDir string) (ref string, id string, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+
+	head := strings.TrimSpace(string(contents))
+	if strings.HasPrefix(head, "ref: ") {
+		ref = strings.TrimPrefix(head, "ref: ")
+		id, _ = resolveGitRef(gitDir, ref)
+		return ref, id, nil
+	}
+
+	return "", head, nil
+}
+
+// A status with only the branch headers, from HEAD
+func readGitHeadStatus(gitDir string) (*GitPorcelainStatus, error) {
+	ref, id, err := readGitHead(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitPorcelainStatus{
+		Files:           []RepoFileStatus{},
+		Detached:        ref == "",
+		Head:            strings.TrimPrefix(ref, "refs/heads/"),
+		Oid:             id,
+		HasInitialState: id == "",
+	}, nil
+}
+
+// Resolve a ref name to an object id, following symbolic refs
+func resolveGitRef(gitDir string, ref string) (string, bool) {
+	commonDir := gitCommonDir(gitDir)
+
+	for depth := 0; depth < 5; depth++ {
+		// Per-worktree refs live in the worktree's own git directory
+		dir := commonDir
+		if ref == "HEAD" || strings.HasPrefix(ref, "refs/bisect/") || strings.HasPrefix(ref, "refs/worktree/") {
+			dir = gitDir
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(ref)))
+		if err != nil {
+			id, ok := readPackedRefs(commonDir)[ref]
+			return id, ok
+		}
+
+		value := strings.TrimSpace(string(contents))
+		if !strings.HasPrefix(value, "ref: ") {
+			return value, value != ""
+		}
+		ref = strings.TrimPrefix(value, "ref: ")
+	}
+
+	return "", false
+}
+
+// Where a symbolic ref (like refs/remotes/origin/HEAD) points
+func readGitSymbolicRef(commonDir string, ref string) (string, bool) {
+	contents, err := ioutil.ReadFile(filepath.Join(commonDir, filepath.FromSlash(ref)))
+	if err != nil {
+		return "", false
+	}
+
+	value := strings.TrimSpace(string(contents))
+	if !strings.HasPrefix(value, "ref: ") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(value, "ref: "), true
+}
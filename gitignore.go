@@ -0,0 +1,160 @@
+package main
+
+/**
+ * gitignore pattern matching, for finding untracked files without running git
+ */
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type gitIgnorePattern struct {
+	base     string
+	regex    *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+type GitIgnore struct {
+	patterns []gitIgnorePattern
+}
+
+// Add the patterns in a file; base is the file's directory relative to the worktree root ("" for the root)
+func (g *GitIgnore) AddFile(filename string, base string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		g.AddPattern(scanner.Text(), base)
+	}
+}
+
+func (g *GitIgnore) AddPattern(line string, base string) {
+	line = strings.TrimRight(line, "\r")
+
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if len(line) == 0 || line[0] == '#' {
+		return
+	}
+
+	pattern := gitIgnorePattern{base: base}
+
+	if line[0] == '!' {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// A slash anywhere but the end anchors the pattern to its .gitignore's directory
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if len(line) == 0 {
+		return
+	}
+
+	regex, err := regexp.Compile("^" + gitGlobToRegexp(line) + "$")
+	if err != nil {
+		return
+	}
+	pattern.regex = regex
+
+	g.patterns = append(g.patterns, pattern)
+}
+
+// Whether a path (relative to the worktree root) is ignored; the last matching pattern wins
+func (g *GitIgnore) Ignored(relPath string, isDir bool) bool {
+	ignored := false
+
+	for _, pattern := range g.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+
+		candidate := relPath
+		if pattern.base != "" {
+			if !strings.HasPrefix(relPath, pattern.base+"/") {
+				continue
+			}
+			candidate = strings.TrimPrefix(relPath, pattern.base+"/")
+		}
+
+		if !pattern.anchored {
+			candidate = path.Base(candidate)
+		}
+
+		if pattern.regex.MatchString(candidate) {
+			ignored = !pattern.negate
+		}
+	}
+
+	return ignored
+}
+
+func gitGlobToRegexp(glob string) string {
+	var regex strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+
+		switch ch {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/') {
+				// Zero or more leading directories
+				regex.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") && i+2 == len(glob) && (i == 0 || glob[i-1] == '/') {
+				// Everything inside
+				regex.WriteString(".*")
+				i++
+			} else {
+				regex.WriteString("[^/]*")
+			}
+		case '?':
+			regex.WriteString("[^/]")
+		case '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				regex.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				regex.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			regex.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	return regex.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGitIgnoreIgnored(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		base     string
+		path     string
+		isDir    bool
+		ignored  bool
+	}{
+		{"basename anywhere", []string{"*.log"}, "", "a/b/debug.log", false, true},
+		{"no match", []string{"*.log"}, "", "a/b/debug.txt", false, false},
+		{"negated", []string{"*.log", "!keep.log"}, "", "a/keep.log", false, false},
+		{"negation undone", []string{"*.log", "!keep.log", "keep.log"}, "", "keep.log", false, true},
+		{"negation first", []string{"!keep.log", "*.log"}, "", "keep.log", false, true},
+		{"escaped bang", []string{"\\!important"}, "", "!important", false, true},
+		{"comment", []string{"#notes"}, "", "#notes", false, false},
+		{"escaped hash", []string{"\\#notes"}, "", "#notes", false, true},
+		{"dir only on dir", []string{"tmp/"}, "", "a/tmp", true, true},
+		{"dir only on file", []string{"tmp/"}, "", "a/tmp", false, false},
+		{"anchored", []string{"/root.txt"}, "", "root.txt", false, true},
+		{"anchored elsewhere", []string{"/root.txt"}, "", "sub/root.txt", false, false},
+		{"middle slash anchors", []string{"doc/*.txt"}, "", "doc/a.txt", false, true},
+		{"middle slash anchored elsewhere", []string{"doc/*.txt"}, "", "x/doc/a.txt", false, false},
+		{"star stays in a directory", []string{"doc/*.txt"}, "", "doc/sub/a.txt", false, false},
+		{"leading double star", []string{"**/build"}, "", "a/b/build", true, true},
+		{"leading double star at root", []string{"**/build"}, "", "build", true, true},
+		{"trailing double star", []string{"out/**"}, "", "out/a/b.o", false, true},
+		{"trailing double star not the dir", []string{"out/**"}, "", "out", true, false},
+		{"middle double star", []string{"a/**/b"}, "", "a/x/y/b", false, true},
+		{"middle double star, no dirs", []string{"a/**/b"}, "", "a/b", false, true},
+		{"question mark", []string{"file?.c"}, "", "file1.c", false, true},
+		{"question mark not slash", []string{"a?b"}, "", "a/b", false, false},
+		{"class", []string{"[abc].c"}, "", "b.c", false, true},
+		{"negated class", []string{"[!abc].c"}, "", "b.c", false, false},
+		{"trailing spaces", []string{"spaced   "}, "", "spaced", false, true},
+		{"escaped trailing space", []string{"spaced\\ "}, "", "spaced ", false, true},
+		{"nested gitignore", []string{"/local"}, "sub", "sub/local", false, true},
+		{"nested gitignore elsewhere", []string{"/local"}, "sub", "local", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ignore := &GitIgnore{}
+			for _, pattern := range test.patterns {
+				ignore.AddPattern(pattern, test.base)
+			}
+
+			if ignored := ignore.Ignored(test.path, test.isDir); ignored != test.ignored {
+				t.Errorf("%q (dir %v) against %q: ignored %v, expected %v", test.path, test.isDir, test.patterns, ignored, test.ignored)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+/**
+ * Reader for the git index (.git/index), versions 2 through 4
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	gitIndexFlagExtended     = 0x4000
+	gitIndexFlagStageMask    = 0x3000
+	gitIndexExtSkipWorktree  = 0x4000
+	gitIndexExtIntentToAdd   = 0x2000
+	gitIndexNameLengthMask   = 0x0fff
+	gitIndexEntryFixedLength = 62
+)
+
+type GitIndexEntry struct {
+	CtimeSec     uint32
+	CtimeNsec    uint32
+	MtimeSec     uint32
+	MtimeNsec    uint32
+	Dev          uint32
+	Ino          uint32
+	Mode         uint32
+	Uid          uint32
+	Gid          uint32
+	Size         uint32
+	Id           string
+	Stage        int
+	SkipWorktree bool
+	IntentToAdd  bool
+	Path         string
+}
+
+type GitIndex struct {
+	Entries []GitIndexEntry
+
+	// The cache-tree extension: tree ids for directories ("" for the root) whose index entries haven't changed
+	// since they were last written as trees
+	CacheTree map[string]string
+}
+
+func readGitIndex(path string) (*GitIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 12+20 || string(data[:4]) != "DIRC" {
+		return nil, fmt.Errorf("not an index file: '%s'", path)
+	}
+
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	entries := make([]GitIndexEntry, 0, count)
+
+	// The trailing 20 bytes are a checksum
+	end := len(data) - 20
+	pos := 12
+	previousPath := ""
+
+	for i := 0; i < count; i++ {
+		if pos+gitIndexEntryFixedLength > end {
+			return nil, fmt.Errorf("truncated index '%s'", path)
+		}
+
+		start := pos
+		field := func(n int) uint32 {
+			return binary.BigEndian.Uint32(data[start+n*4:])
+		}
+
+		entry := GitIndexEntry{
+			CtimeSec:  field(0),
+			CtimeNsec: field(1),
+			MtimeSec:  field(2),
+			MtimeNsec: field(3),
+			Dev:       field(4),
+			Ino:       field(5),
+			Mode:      field(6),
+			Uid:       field(7),
+			Gid:       field(8),
+			Size:      field(9),
+			Id:        hex.EncodeToString(data[start+40 : start+60]),
+		}
+
+		flags := binary.BigEndian.Uint16(data[start+60:])
+		entry.Stage = int(flags&gitIndexFlagStageMask) >> 12
+		pos = start + gitIndexEntryFixedLength
+
+		if version >= 3 && flags&gitIndexFlagExtended != 0 {
+			if pos+2 > end {
+				return nil, fmt.Errorf("truncated index '%s'", path)
+			}
+			extended := binary.BigEndian.Uint16(data[pos:])
+			entry.SkipWorktree = extended&gitIndexExtSkipWorktree != 0
+			entry.IntentToAdd = extended&gitIndexExtIntentToAdd != 0
+			pos += 2
+		}
+
+		if version == 4 {
+			// Path is prefix-compressed against the previous entry
+			strip, n := binary.Uvarint(data[pos:end])
+			if n <= 0 || int(strip) > len(previousPath) {
+				return nil, fmt.Errorf("malformed index path in '%s'", path)
+			}
+			pos += n
+			nul := bytes.IndexByte(data[pos:end], 0)
+			if nul < 0 {
+				return nil, fmt.Errorf("malformed index path in '%s'", path)
+			}
+			entry.Path = previousPath[:len(previousPath)-int(strip)] + string(data[pos:pos+nul])
+			pos += nul + 1
+		} else {
+			nul := bytes.IndexByte(data[pos:end], 0)
+			if nul < 0 {
+				return nil, fmt.Errorf("malformed index path in '%s'", path)
+			}
+			entry.Path = string(data[pos : pos+nul])
+			// Entries are NUL padded to a multiple of eight bytes
+			pos += nul + 1
+			for (pos-start)%8 != 0 {
+				pos++
+			}
+		}
+
+		// Sparse indexes store whole directories as entries, which we can't compare
+		if entry.Mode&0170000 == 040000 {
+			return nil, fmt.Errorf("sparse index is not supported")
+		}
+
+		previousPath = entry.Path
+		entries = append(entries, entry)
+	}
+
+	index := &GitIndex{Entries: entries, CacheTree: map[string]string{}}
+
+	// Extensions: a split index means the entries above are incomplete
+	for pos+8 <= end {
+		signature := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4:]))
+		if pos+8+size > end {
+			return nil, fmt.Errorf("truncated index extension in '%s'", path)
+		}
+
+		switch signature {
+		case "link":
+			return nil, fmt.Errorf("split index is not supported")
+		case "TREE":
+			if err := parseGitCacheTree(data[pos+8:pos+8+size], index.CacheTree); err != nil {
+				// Only an optimization, so do without
+				index.CacheTree = map[string]string{}
+			}
+		}
+		pos += 8 + size
+	}
+
+	return index, nil
+}
+
+// Cache-tree nodes, depth first: "<name>\0<entry count> <subtree count>\n", then the tree id unless the count is
+// -1 (invalidated), then the subtrees
+func parseGitCacheTree(data []byte, trees map[string]string) error {
+	var parse func(prefix string) error
+	parse = func(prefix string) error {
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 {
+			return fmt.Errorf("malformed cache tree")
+		}
+		dir := string(data[:nul])
+		if prefix != "" {
+			dir = prefix + "/" + dir
+		}
+		data = data[nul+1:]
+
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 {
+			return fmt.Errorf("malformed cache tree")
+		}
+		var count, subtrees int
+		if _, err := fmt.Sscanf(string(data[:newline]), "%d %d", &count, &subtrees); err != nil {
+			return err
+		}
+		data = data[newline+1:]
+
+		if count >= 0 {
+			if len(data) < 20 {
+				return fmt.Errorf("malformed cache tree")
+			}
+			trees[dir] = hex.EncodeToString(data[:20])
+			data = data[20:]
+		}
+
+		for i := 0; i < subtrees; i++ {
+			if err := parse(dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return parse("")
+}
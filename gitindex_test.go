@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadGitIndex(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q")
+
+	// Shared prefixes, so version 4 has paths to compress
+	for _, path := range []string{"alpha", "alphabet", "dir/alpha", "dir/alphabet", "dir/beta", "dir/sub/deep", "other/file"} {
+		writeTestFile(t, filepath.Join(dir, path), path+"\n")
+	}
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+
+	// Leave "dir" unchanged since HEAD, and "other" and the root changed
+	writeTestFile(t, filepath.Join(dir, "other", "file"), "changed\n")
+	runGit(t, dir, "add", "other/file")
+	writeTestFile(t, filepath.Join(dir, "intended"), "intended\n")
+	runGit(t, dir, "add", "-N", "intended")
+
+	indexPath := filepath.Join(dir, ".git", "index")
+
+	for _, version := range []int{2, 3, 4} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			if version == 2 {
+				// Version 2 can't record intent-to-add
+				runGit(t, dir, "rm", "-q", "--cached", "intended")
+				defer runGit(t, dir, "add", "-N", "intended")
+			}
+			runGit(t, dir, "update-index", "--index-version", fmt.Sprint(version))
+
+			data, err := os.ReadFile(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := binary.BigEndian.Uint32(data[4:8]); written != uint32(version) {
+				t.Fatalf("git wrote version %d", written)
+			}
+
+			index, err := readGitIndex(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := strings.Split(strings.TrimSpace(runGit(t, dir, "ls-files", "-s")), "\n")
+			if len(index.Entries) != len(expected) {
+				t.Fatalf("Read %d entries, expected %d", len(index.Entries), len(expected))
+			}
+			for i, entry := range index.Entries {
+				if got := fmt.Sprintf("%06o %s %d\t%s", entry.Mode, entry.Id, entry.Stage, entry.Path); got != expected[i] {
+					t.Errorf("Entry %d: %q, expected %q", i, got, expected[i])
+				}
+				if entry.IntentToAdd != (entry.Path == "intended") {
+					t.Errorf("%s: intent-to-add %v", entry.Path, entry.IntentToAdd)
+				}
+			}
+
+			if tree := index.CacheTree["dir"]; tree != strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD:dir")) {
+				t.Errorf("Cache-tree has %q for 'dir'", tree)
+			}
+			if tree := index.CacheTree["dir/sub"]; tree != strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD:dir/sub")) {
+				t.Errorf("Cache-tree has %q for 'dir/sub'", tree)
+			}
+			for _, changed := range []string{"", "other"} {
+				if tree, ok := index.CacheTree[changed]; ok {
+					t.Errorf("Cache-tree has %q for changed '%s'", tree, changed)
+				}
+			}
+		})
+	}
+}
+
+func TestReadGitIndexErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	header := func(version uint32, count uint32) []byte {
+		data := append([]byte("DIRC"), make([]byte, 8)...)
+		binary.BigEndian.PutUint32(data[4:], version)
+		binary.BigEndian.PutUint32(data[8:], count)
+		return data
+	}
+	checksum := make([]byte, 20)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong signature", append(append([]byte("DIRX"), header(2, 0)[4:]...), checksum...)},
+		{"version 1", append(header(1, 0), checksum...)},
+		{"version 5", append(header(5, 0), checksum...)},
+		{"missing entries", append(header(2, 1), checksum...)},
+		{"truncated extension", append(append(header(2, 0), "TREE\x00\x00\x01\x00"...), checksum...)},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "index")
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readGitIndex(path); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
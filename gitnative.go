@@ -0,0 +1,754 @@
+package main
+
+/**
+ * Native Git Repo Information: reads the .git directory directly instead of running git
+ */
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Reads .git itself; never picked when detecting, since git finds the same repositories
+type gitNativeBackend struct{}
+
+func init() {
+	registerBackend(gitNativeBackend{}, gitStatusFields)
+}
+
+func (gitNativeBackend) Name() string {
+	return "gitnative"
+}
+
+func (gitNativeBackend) Detect(dir string) (Detection, bool) {
+	return detectGitRepo(dir, 0)
+}
+
+// Falls back to running git for anything we can't read ourselves
+func (gitNativeBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	if info := NewNativeGitRepoInfo(ctx, &req.Directory, r); info != nil {
+		return info
+	}
+	return NewGitRepoInfo(ctx, &req.Directory, r)
+}
+
+// Returns nil when the repository uses something we can't read natively, so callers can fall back to NewGitRepoInfo
+func NewNativeGitRepoInfo(ctx context.Context, workingDirectory *string, r *Renderer) *RepoInfo {
+	codes := currentConfig().Fields("git")
+
+	if gitDir, ok := findEnclosingGitDir(*workingDirectory); ok {
+		return newGitDirRepoInfo(gitDir, r)
+	}
+
+	root, gitDir, found := findGitRoot(*workingDirectory)
+	if !found {
+		// Not a git repo
+		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
+	}
+
+	config := loadGitConfig(gitDir)
+	if format, ok := config.Get("extensions.objectFormat"); ok && format != "sha1" {
+		return nil
+	}
+	if storage, ok := config.Get("extensions.refStorage"); ok && storage != "files" {
+		// Reftable keeps refs in a binary format, leaving HEAD pointing at a placeholder
+		return nil
+	}
+
+	// On timeout this falls back to NewGitRepoInfo too, which reports what it can without more waiting
+	parsed, err := nativeGitStatus(ctx, root, gitDir, config)
+	if err != nil {
+		return nil
+	}
+
+	info, gitDir, found := newGitRepoInfo(workingDirectory, r)
+	fillGitRepoInfo(info, gitDir, found, parsed, r)
+
+	return info
+}
+
+// Build the same status `git status --porcelain=v2 --branch` would report
+func nativeGitStatus(ctx context.Context, root string, gitDir string, config GitConfig) (*GitPorcelainStatus, error) {
+	commonDir := gitCommonDir(gitDir)
+
+	store, err := openGitObjectStore(commonDir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	status := &GitPorcelainStatus{Files: []RepoFileStatus{}}
+
+	// Branch headers
+	ref, headId, err := readGitHead(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if ref == "" {
+		status.Detached = true
+	} else {
+		status.Head = strings.TrimPrefix(ref, "refs/heads/")
+	}
+
+	if headId == "" {
+		status.HasInitialState = true
+	} else {
+		status.Oid = headId
+	}
+
+	if !status.Detached {
+		if err := nativeGitUpstream(status, gitDir, config, store); err != nil {
+			return nil, err
+		}
+	}
+
+	indexPath := filepath.Join(gitDir, "index")
+	index, err := readGitIndex(indexPath)
+	if os.IsNotExist(err) {
+		index, err = &GitIndex{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := index.Entries
+
+	// Staged changes: index against HEAD's tree, skipping directories the cache-tree says are as they were in HEAD
+	headTree := map[string]GitTreeEntry{}
+	unchangedDirs := map[string]bool{}
+	if headId != "" {
+		commit, err := store.ReadCommit(headId)
+		if err != nil {
+			return nil, err
+		}
+		if headTree, unchangedDirs, err = store.FlattenTree(commit.Tree, index.CacheTree); err != nil {
+			return nil, err
+		}
+	}
+
+	if gitConvertsContent(root, gitDir, config, entries) {
+		return nil, fmt.Errorf("content filters and line ending conversion are not supported")
+	}
+
+	indexStat, _ := os.Stat(indexPath)
+
+	tracked := map[string]bool{}
+	unmerged := map[string][]int{}
+	fileMode := config.GetBool("core.fileMode", true)
+
+	changes := []RepoFileStatus{}
+	ids := map[string]string{}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		tracked[entry.Path] = true
+
+		if entry.Stage != 0 {
+			unmerged[entry.Path] = append(unmerged[entry.Path], entry.Stage)
+			continue
+		}
+
+		x := byte('.')
+		y := byte('.')
+
+		if entry.IntentToAdd {
+			y = 'A'
+		} else if isInGitDir(entry.Path, unchangedDirs) {
+			// Unchanged since HEAD, according to the cache-tree
+		} else if head, ok := headTree[entry.Path]; !ok {
+			x = 'A'
+			ids[entry.Path] = entry.Id
+		} else if head.Id != entry.Id || (head.Mode != entry.Mode && fileMode) {
+			x = 'M'
+		}
+
+		submodule := ""
+		if !entry.SkipWorktree && !entry.IntentToAdd {
+			y, submodule = nativeGitWorktreeChange(ctx, root, &entry, indexStat, fileMode)
+		}
+
+		if x != '.' || y != '.' {
+			changes = append(changes, RepoFileStatus{Path: entry.Path, Code: string([]byte{x, y}), Submodule: submodule})
+		}
+	}
+
+	// Anything in HEAD that's no longer in the index has been staged for deletion
+	deleted := map[string]string{}
+	for file, entry := range headTree {
+		if !tracked[file] {
+			deleted[entry.Id] = file
+			submodule := ""
+			if entry.Mode == 0160000 {
+				submodule = "S..."
+			}
+			changes = append(changes, RepoFileStatus{Path: file, Code: "D.", Submodule: submodule})
+		}
+	}
+
+	// Pair up exact renames (git also finds similar-content renames, which we don't)
+	renamedFrom := map[string]bool{}
+	for i := range changes {
+		if changes[i].Code[0] != 'A' {
+			continue
+		}
+		if orig, ok := deleted[ids[changes[i].Path]]; ok {
+			delete(deleted, ids[changes[i].Path])
+			renamedFrom[orig] = true
+			changes[i].Code = "R" + changes[i].Code[1:]
+			changes[i].OrigPath = orig
+		}
+	}
+
+	for _, change := range changes {
+		if change.Code == "D." && renamedFrom[change.Path] {
+			continue
+		}
+		status.addTracked(change)
+	}
+
+	sort.SliceStable(status.Files, func(i, j int) bool {
+		return status.Files[i].Path < status.Files[j].Path
+	})
+
+	// Like git, unmerged files come after the other tracked ones
+	conflicted := []string{}
+	for file := range unmerged {
+		conflicted = append(conflicted, file)
+	}
+	sort.Strings(conflicted)
+	for _, file := range conflicted {
+		status.HasUnmerged = true
+		status.Files = append(status.Files, RepoFileStatus{Path: file, Code: unmergedGitCode(unmerged[file])})
+	}
+
+	// Untracked files come after everything tracked
+	untracked, err := nativeGitUntracked(ctx, root, gitDir, config, tracked)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(untracked)
+	for _, file := range untracked {
+		status.HasUntracked = true
+		status.Files = append(status.Files, RepoFileStatus{Path: file, Code: "??"})
+	}
+
+	return status, nil
+}
+
+// Fill in the upstream branch and ahead/behind counts from branch.<name>.remote/merge
+func nativeGitUpstream(status *GitPorcelainStatus, gitDir string, config GitConfig, store *GitObjectStore) error {
+	remote, hasRemote := config.Get("branch." + status.Head + ".remote")
+	merge, hasMerge := config.Get("branch." + status.Head + ".merge")
+	if !hasRemote || !hasMerge {
+		return nil
+	}
+
+	var upstreamRef string
+	if remote == "." {
+		upstreamRef = merge
+		status.Upstream = strings.TrimPrefix(merge, "refs/heads/")
+	} else {
+		// Where fetching puts the merge ref; nothing there means no upstream, as far as git is concerned
+		var found bool
+		upstreamRef, found = mapGitFetchRefspecs(config.GetAll("remote."+remote+".fetch"), merge)
+		if !found {
+			return nil
+		}
+		status.Upstream = strings.TrimPrefix(strings.TrimPrefix(upstreamRef, "refs/remotes/"), "refs/heads/")
+	}
+
+	upstreamId, ok := resolveGitRef(gitDir, upstreamRef)
+	if !ok {
+		// Upstream is gone
+		return nil
+	}
+
+	if status.Oid == "" {
+		return nil
+	}
+
+	ahead, behind, err := gitAheadBehind(store, status.Oid, upstreamId)
+	if err != nil {
+		return err
+	}
+
+	status.Ahead = ahead
+	status.Behind = behind
+	status.HasAheadBehind = true
+
+	return nil
+}
+
+// The local ref a remote's fetch refspecs map ref to; the first matching refspec wins.  Like git, this
+// ignores negative ("^") refspecs.
+func mapGitFetchRefspecs(refspecs []string, ref string) (string, bool) {
+	for _, refspec := range refspecs {
+		colon := strings.Index(refspec, ":")
+		if strings.HasPrefix(refspec, "^") || colon < 0 {
+			continue
+		}
+
+		if mapped, ok := matchGitRefspecPattern(strings.TrimPrefix(refspec[:colon], "+"), ref, refspec[colon+1:]); ok {
+			return mapped, true
+		}
+	}
+
+	return "", false
+}
+
+// If ref matches pattern (with at most one "*"), the destination with "*" replaced by what it matched
+func matchGitRefspecPattern(pattern string, ref string, destination string) (string, bool) {
+	star := strings.Index(pattern, "*")
+	if star < 0 {
+		return destination, ref == pattern
+	}
+
+	prefix, suffix := pattern[:star], pattern[star+1:]
+	if len(ref) < len(prefix)+len(suffix) || !strings.HasPrefix(ref, prefix) || !strings.HasSuffix(ref, suffix) {
+		return "", false
+	}
+
+	return strings.Replace(destination, "*", ref[len(prefix):len(ref)-len(suffix)], 1), true
+}
+
+// The worktree-side status character for a tracked file, and its submodule field
+func nativeGitWorktreeChange(ctx context.Context, root string, entry *GitIndexEntry, indexStat os.FileInfo, fileMode bool) (byte, string) {
+	fullPath := filepath.Join(root, filepath.FromSlash(entry.Path))
+
+	stat, err := os.Lstat(fullPath)
+	if err != nil {
+		if entry.Mode == 0160000 {
+			// Uninitialized submodules just aren't there
+			return '.', "S..."
+		}
+		return 'D', ""
+	}
+
+	if entry.Mode == 0160000 {
+		return nativeGitSubmoduleChange(ctx, fullPath, entry)
+	}
+
+	if !stat.Mode().IsRegular() && stat.Mode()&os.ModeSymlink == 0 {
+		// A directory (or something stranger) where a file used to be
+		return 'D', ""
+	}
+
+	// Type and executable bit changes
+	if stat.Mode()&os.ModeSymlink != 0 {
+		if entry.Mode&0170000 != 0120000 {
+			return 'T', ""
+		}
+	} else {
+		if entry.Mode&0170000 == 0120000 {
+			return 'T', ""
+		}
+		if fileMode && (stat.Mode()&0100 != 0) != (entry.Mode&0100 != 0) {
+			return 'M', ""
+		}
+	}
+
+	if nativeGitStatMatches(entry, stat, indexStat) {
+		return '.', ""
+	}
+
+	// Stat data differs (or can't be trusted), so compare the contents
+	id, err := gitHashWorktreeFile(fullPath, stat)
+	if err != nil || id != entry.Id {
+		return 'M', ""
+	}
+
+	return '.', ""
+}
+
+// Gitlinks: compare the submodule's checked out commit, and look for changes inside it
+func nativeGitSubmoduleChange(ctx context.Context, fullPath string, entry *GitIndexEntry) (byte, string) {
+	gitDir, err := resolveGitDir(filepath.Join(fullPath, ".git"))
+	if err != nil {
+		return '.', "S..."
+	}
+
+	flags := []byte("S...")
+
+	if _, id, err := readGitHead(gitDir); err == nil && id != "" && id != entry.Id {
+		flags[1] = 'C'
+	}
+
+	if sub, err := nativeGitStatus(ctx, fullPath, gitDir, loadGitConfig(gitDir)); err == nil {
+		if sub.HasStaged || sub.HasUnstaged || sub.HasUnmerged {
+			flags[2] = 'M'
+		}
+		if sub.HasUntracked {
+			flags[3] = 'U'
+		}
+	}
+
+	if string(flags) == "S..." {
+		return '.', string(flags)
+	}
+	return 'M', string(flags)
+}
+
+func nativeGitStatMatches(entry *GitIndexEntry, stat os.FileInfo, indexStat os.FileInfo) bool {
+	if uint32(stat.Size()) != entry.Size {
+		return false
+	}
+
+	mtime := stat.ModTime()
+	if uint32(mtime.Unix()) != entry.MtimeSec || uint32(mtime.Nanosecond()) != entry.MtimeNsec {
+		return false
+	}
+
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		if uint32(sys.Ino) != entry.Ino {
+			return false
+		}
+	}
+
+	// Racily clean: modified in the same instant the index was written, so stat can't tell us
+	if indexStat != nil && !mtime.Before(indexStat.ModTime()) {
+		return false
+	}
+
+	return true
+}
+
+// The blob id git would give a worktree file
+func gitHashWorktreeFile(fullPath string, stat os.FileInfo) (string, error) {
+	var contents []byte
+	var err error
+
+	if stat.Mode()&os.ModeSymlink != 0 {
+		var target string
+		target, err = os.Readlink(fullPath)
+		contents = []byte(target)
+	} else {
+		contents, err = ioutil.ReadFile(fullPath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.New()
+	_, _ = fmt.Fprintf(hash, "blob %d\x00", len(contents))
+	_, _ = hash.Write(contents)
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Whether path is somewhere under one of dirs ("" being the root)
+func isInGitDir(path string, dirs map[string]bool) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	if dirs[""] {
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && dirs[path[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Attributes that can make a worktree file differ from the blob git would store for it
+var gitConversionAttributes = map[string]bool{"filter": true, "text": true, "eol": true, "crlf": true, "ident": true,
+	"working-tree-encoding": true}
+
+// Whether git would convert worktree files (core.autocrlf, or attributes asking for filters like git-lfs or line
+// ending conversion), so hashing them as they are would report changes git doesn't see
+func gitConvertsContent(root string, gitDir string, config GitConfig, entries []GitIndexEntry) bool {
+	if autocrlf, _ := config.Get("core.autocrlf"); strings.ToLower(autocrlf) == "input" || config.GetBool("core.autocrlf", false) {
+		return true
+	}
+
+	attributesFile, ok := config.Get("core.attributesFile")
+	if !ok {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" {
+			xdg = filepath.Join(os.Getenv("HOME"), ".config")
+		}
+		attributesFile = filepath.Join(xdg, "git", "attributes")
+	}
+
+	files := []string{"/etc/gitattributes", expandTilde(attributesFile), filepath.Join(gitCommonDir(gitDir), "info", "attributes")}
+	for _, entry := range entries {
+		if entry.Path == ".gitattributes" || strings.HasSuffix(entry.Path, "/.gitattributes") {
+			files = append(files, filepath.Join(root, filepath.FromSlash(entry.Path)))
+		}
+	}
+
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(contents), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+
+			for _, attribute := range fields[1:] {
+				// Unset ("-text") and unspecified ("!text") attributes don't convert anything
+				if strings.HasPrefix(attribute, "-") || strings.HasPrefix(attribute, "!") {
+					continue
+				}
+				if gitConversionAttributes[strings.SplitN(attribute, "=", 2)[0]] {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Unmerged XY codes, from which stages are present (1: base, 2: ours, 3: theirs)
+func unmergedGitCode(stages []int) string {
+	present := 0
+	for _, stage := range stages {
+		present |= 1 << uint(stage-1)
+	}
+
+	switch present {
+	case 1:
+		return "DD"
+	case 2:
+		return "AU"
+	case 3:
+		return "UD"
+	case 4:
+		return "UA"
+	case 5:
+		return "DU"
+	case 6:
+		return "AA"
+	}
+	return "UU"
+}
+
+// Untracked paths, collapsing wholly untracked directories to "dir/" like git does
+func nativeGitUntracked(ctx context.Context, root string, gitDir string, config GitConfig, tracked map[string]bool) ([]string, error) {
+	ignore := &GitIgnore{}
+
+	excludesFile, ok := config.Get("core.excludesFile")
+	if !ok {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" {
+			xdg = filepath.Join(os.Getenv("HOME"), ".config")
+		}
+		excludesFile = filepath.Join(xdg, "git", "ignore")
+	}
+	ignore.AddFile(expandTilde(excludesFile), "")
+	ignore.AddFile(filepath.Join(gitCommonDir(gitDir), "info", "exclude"), "")
+
+	// Every directory containing a tracked file
+	trackedDirs := map[string]bool{}
+	for file := range tracked {
+		for dir := filepath.ToSlash(filepath.Dir(file)); dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			if trackedDirs[dir] {
+				break
+			}
+			trackedDirs[dir] = true
+		}
+	}
+
+	untracked := []string{}
+	err := nativeGitWalkUntracked(ctx, root, "", ignore, tracked, trackedDirs, &untracked)
+
+	return untracked, err
+}
+
+func nativeGitWalkUntracked(ctx context.Context, root string, relDir string, ignore *GitIgnore, tracked map[string]bool, trackedDirs map[string]bool, untracked *[]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ignore.AddFile(filepath.Join(root, filepath.FromSlash(relDir), ".gitignore"), relDir)
+
+	// Directory entry types are enough; no need to stat every child
+	children, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(relDir)))
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		name := child.Name()
+		relPath := name
+		if relDir != "" {
+			relPath = relDir + "/" + name
+		}
+
+		if name == ".git" || tracked[relPath] {
+			continue
+		}
+
+		isDir := child.IsDir()
+		if ignore.Ignored(relPath, isDir) {
+			continue
+		}
+
+		if !isDir {
+			*untracked = append(*untracked, relPath)
+			continue
+		}
+
+		if trackedDirs[relPath] {
+			if err := nativeGitWalkUntracked(ctx, root, relPath, ignore, tracked, trackedDirs, untracked); err != nil {
+				return err
+			}
+		} else if nativeGitHasUntrackedContent(root, relPath, ignore) {
+			*untracked = append(*untracked, relPath+"/")
+		}
+	}
+
+	return nil
+}
+
+// Whether a wholly untracked directory has anything in it that isn't ignored
+func nativeGitHasUntrackedContent(root string, relDir string, ignore *GitIgnore) bool {
+	// Nested repositories always show up
+	if fileExists(filepath.Join(root, filepath.FromSlash(relDir), ".git")) {
+		return true
+	}
+
+	// Scope the nested .gitignore to this check
+	saved := len(ignore.patterns)
+	defer func() { ignore.patterns = ignore.patterns[:saved] }()
+	ignore.AddFile(filepath.Join(root, filepath.FromSlash(relDir), ".gitignore"), relDir)
+
+	// Directory entry types are enough; no need to stat every child
+	children, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(relDir)))
+	if err != nil {
+		return false
+	}
+
+	for _, child := range children {
+		relPath := relDir + "/" + child.Name()
+		if ignore.Ignored(relPath, child.IsDir()) {
+			continue
+		}
+		if !child.IsDir() || nativeGitHasUntrackedContent(root, relPath, ignore) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Ahead/behind: walk both histories newest-first until only shared ancestors remain
+//
+
+const (
+	gitWalkLeft  = 1
+	gitWalkRight = 2
+	gitWalkBoth  = gitWalkLeft | gitWalkRight
+)
+
+type gitWalkItem struct {
+	id   string
+	time int64
+}
+
+type gitWalkQueue []gitWalkItem
+
+func (q gitWalkQueue) Len() int            { return len(q) }
+func (q gitWalkQueue) Less(i, j int) bool  { return q[i].time > q[j].time }
+func (q gitWalkQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *gitWalkQueue) Push(x interface{}) { *q = append(*q, x.(gitWalkItem)) }
+func (q *gitWalkQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func gitAheadBehind(store *GitObjectStore, local string, upstream string) (ahead int, behind int, err error) {
+	if local == upstream {
+		return 0, 0, nil
+	}
+
+	flags := map[string]int{}
+	commits := map[string]*GitCommit{}
+	queued := map[string]bool{}
+	queue := &gitWalkQueue{}
+
+	// Queued commits not yet known to be shared; once there are none, nothing left can change the counts
+	pending := 0
+
+	push := func(id string, flag int) error {
+		previous, seen := flags[id]
+		if seen && previous|flag == previous {
+			return nil
+		}
+		flags[id] = previous | flag
+
+		if queued[id] && flags[id] == gitWalkBoth {
+			pending--
+		}
+
+		commit, ok := commits[id]
+		if !ok {
+			if commit, err = store.ReadCommit(id); err != nil {
+				return err
+			}
+			commits[id] = commit
+		}
+
+		// Newly seen, or picked up a flag after we passed it: (re)visit its parents
+		if !queued[id] {
+			queued[id] = true
+			heap.Push(queue, gitWalkItem{id: id, time: commit.CommitterTime})
+			if flags[id] != gitWalkBoth {
+				pending++
+			}
+		}
+		return nil
+	}
+
+	if err = push(local, gitWalkLeft); err != nil {
+		return
+	}
+	if err = push(upstream, gitWalkRight); err != nil {
+		return
+	}
+
+	for pending > 0 {
+		item := heap.Pop(queue).(gitWalkItem)
+		queued[item.id] = false
+		if flags[item.id] != gitWalkBoth {
+			pending--
+		}
+
+		for _, parent := range commits[item.id].Parents {
+			if err = push(parent, flags[item.id]); err != nil {
+				return
+			}
+		}
+	}
+
+	for _, flag := range flags {
+		switch flag {
+		case gitWalkLeft:
+			ahead++
+		case gitWalkRight:
+			behind++
+		}
+	}
+
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Git in dir, with an identity so commits work without any user config
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	output, err := gitCommand(dir, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMapGitFetchRefspecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		refspecs []string
+		ref      string
+		mapped   string
+		ok       bool
+	}{
+		{"default", []string{"+refs/heads/*:refs/remotes/origin/*"}, "refs/heads/main", "refs/remotes/origin/main", true},
+		{"nested branch", []string{"+refs/heads/*:refs/remotes/origin/*"}, "refs/heads/a/b", "refs/remotes/origin/a/b", true},
+		{"no plus", []string{"refs/heads/*:refs/remotes/origin/*"}, "refs/heads/main", "refs/remotes/origin/main", true},
+		{"no match", []string{"+refs/heads/*:refs/remotes/origin/*"}, "refs/tags/v1", "", false},
+		{"no refspecs", nil, "refs/heads/main", "", false},
+		{"exact", []string{"refs/heads/main:refs/remotes/origin/main"}, "refs/heads/main", "refs/remotes/origin/main", true},
+		{"exact mismatch", []string{"refs/heads/main:refs/remotes/origin/main"}, "refs/heads/other", "", false},
+		{"mirror", []string{"+refs/*:refs/*"}, "refs/heads/main", "refs/heads/main", true},
+		{"star in the middle", []string{"refs/heads/*-dev:refs/remotes/dev/*"}, "refs/heads/feature-dev", "refs/remotes/dev/feature", true},
+		{"star in the middle mismatch", []string{"refs/heads/*-dev:refs/remotes/dev/*"}, "refs/heads/feature", "", false},
+		{"first match wins", []string{"refs/heads/main:refs/remotes/first/main", "+refs/heads/*:refs/remotes/origin/*"}, "refs/heads/main", "refs/remotes/first/main", true},
+		{"negative ignored", []string{"^refs/heads/main", "+refs/heads/*:refs/remotes/origin/*"}, "refs/heads/main", "refs/remotes/origin/main", true},
+		{"no destination", []string{"refs/heads/main", "+refs/heads/*:refs/remotes/origin/*"}, "refs/heads/main", "refs/remotes/origin/main", true},
+	}
+
+	for _, test := range tests {
+		if mapped, ok := mapGitFetchRefspecs(test.refspecs, test.ref); mapped != test.mapped || ok != test.ok {
+			t.Errorf("%s: got %q, %v; expected %q, %v", test.name, mapped, ok, test.mapped, test.ok)
+		}
+	}
+}
+
+// The RepoInfo as JSON, without the parts that depend on when it was loaded
+func repoInfoJson(t *testing.T, info *RepoInfo) string {
+	t.Helper()
+
+	copied := *info
+	copied.AgeSeconds = 0
+	data, err := json.MarshalIndent(copied, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNativeGitMatchesExec(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	base := t.TempDir()
+	sub := filepath.Join(base, "sub")
+	repo := filepath.Join(base, "repo")
+	linked := filepath.Join(base, "linked")
+
+	runGit(t, base, "init", "-q", sub)
+	writeTestFile(t, filepath.Join(sub, "file"), "sub\n")
+	runGit(t, sub, "add", ".")
+	runGit(t, sub, "commit", "-q", "-m", "sub")
+
+	runGit(t, base, "init", "-q", "-b", "main", repo)
+	writeTestFile(t, filepath.Join(repo, "conflicted"), "base\n")
+	writeTestFile(t, filepath.Join(repo, "old", "name"), "renamed content\n")
+	writeTestFile(t, filepath.Join(repo, "modified"), "before\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "submodule", "add", "-q", sub, "sub")
+	runGit(t, repo, "commit", "-q", "-m", "base")
+
+	runGit(t, repo, "checkout", "-q", "-b", "other")
+	writeTestFile(t, filepath.Join(repo, "conflicted"), "other\n")
+	runGit(t, repo, "commit", "-q", "-am", "other")
+	runGit(t, repo, "checkout", "-q", "main")
+	writeTestFile(t, filepath.Join(repo, "conflicted"), "main\n")
+	runGit(t, repo, "commit", "-q", "-am", "main")
+
+	runGit(t, repo, "worktree", "add", "-q", "-b", "linked", linked)
+	writeTestFile(t, filepath.Join(linked, "modified"), "in the linked worktree\n")
+	writeTestFile(t, filepath.Join(linked, "untracked"), "x\n")
+
+	if output, err := gitCommand(repo, "merge", "-q", "other").CombinedOutput(); !strings.Contains(string(output), "CONFLICT") {
+		t.Fatalf("Merge didn't conflict: %s: %s", err, output)
+	}
+	runGit(t, repo, "mv", "old/name", "new-name")
+	writeTestFile(t, filepath.Join(repo, "modified"), "after\n")
+	writeTestFile(t, filepath.Join(repo, "sub", "file"), "changed in the submodule\n")
+	writeTestFile(t, filepath.Join(repo, "untracked", "file"), "x\n")
+
+	for _, dir := range []string{repo, linked, filepath.Join(repo, "new-name"), filepath.Join(repo, "sub")} {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			if stat, err := os.Stat(dir); err == nil && !stat.IsDir() {
+				dir = filepath.Dir(dir)
+			}
+
+			// Let git refresh the index's stat data first, so both read the same index
+			runGit(t, dir, "status", "-s")
+
+			native := NewNativeGitRepoInfo(context.Background(), &dir, NewRenderer(false))
+			if native == nil {
+				t.Fatal("Native status fell back to git")
+			}
+			execed := NewGitRepoInfo(context.Background(), &dir, NewRenderer(false))
+
+			if got, expected := repoInfoJson(t, native), repoInfoJson(t, execed); got != expected {
+				t.Errorf("Native:\n%s\nexpected:\n%s", got, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+/**
+ * Read-only access to a git object database (loose objects and packfiles)
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	gitObjectCommit   = 1
+	gitObjectTree     = 2
+	gitObjectBlob     = 3
+	gitObjectTag      = 4
+	gitObjectOfsDelta = 6
+	gitObjectRefDelta = 7
+)
+
+var errGitObjectNotFound = errors.New("object not found")
+
+// How much unpacked delta base data to keep around, most recently used first
+const gitDeltaBaseCacheLimit = 16 << 20
+
+type GitObjectStore struct {
+	objectDirs []string
+	packs      []*gitPack
+
+	// Objects other packed objects are deltas against; neighbouring trees and commits often share bases
+	deltaBases     map[gitPackLocation]*list.Element
+	deltaBaseLru   *list.List
+	deltaBaseBytes int
+}
+
+type gitPackLocation struct {
+	pack   *gitPack
+	offset uint64
+}
+
+type gitDeltaBase struct {
+	location gitPackLocation
+	objType  int
+	data     []byte
+}
+
+type gitPack struct {
+	path string
+	file *os.File
+
+	// The .idx file, mapped into memory and searched where it is
+	index []byte
+	count int
+}
+
+type GitCommit struct {
+	Tree          string
+	Parents       []string
+	CommitterTime int64
+}
+
+type GitTreeEntry struct {
+	Mode uint32
+	Id   string
+}
+
+func openGitObjectStore(commonDir string) (*GitObjectStore, error) {
+	store := &GitObjectStore{
+		deltaBases:   map[gitPackLocation]*list.Element{},
+		deltaBaseLru: list.New(),
+	}
+
+	primary := filepath.Join(commonDir, "objects")
+	store.addObjectDir(primary, 0)
+
+	if len(store.objectDirs) == 0 {
+		return nil, fmt.Errorf("no object directory at '%s'", primary)
+	}
+
+	return store, nil
+}
+
+func (s *GitObjectStore) addObjectDir(dir string, depth int) {
+	if depth > 5 || !fileExists(dir) {
+		return
+	}
+
+	s.objectDirs = append(s.objectDirs, dir)
+
+	packFiles, _ := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+	for _, idx := range packFiles {
+		pack, err := readGitPackIndex(idx)
+		if err == nil {
+			s.packs = append(s.packs, pack)
+		}
+	}
+
+	// Objects borrowed from other repositories
+	alternates, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(alternates), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		s.addObjectDir(filepath.Clean(line), depth+1)
+	}
+}
+
+func (s *GitObjectStore) Close() {
+	for _, pack := range s.packs {
+		if pack.file != nil {
+			_ = pack.file.Close()
+		}
+		_ = syscall.Munmap(pack.index)
+	}
+}
+
+// Read an object, returning its type and contents
+func (s *GitObjectStore) Read(id string) (int, []byte, error) {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != 20 {
+		return 0, nil, fmt.Errorf("invalid object id '%s'", id)
+	}
+
+	var key [20]byte
+	copy(key[:], raw)
+
+	for _, dir := range s.objectDirs {
+		objType, data, err := readLooseGitObject(filepath.Join(dir, id[:2], id[2:]))
+		if err == nil {
+			return objType, data, nil
+		}
+	}
+
+	for _, pack := range s.packs {
+		if offset, ok := pack.find(key); ok {
+			return s.readPacked(pack, offset, 0)
+		}
+	}
+
+	return 0, nil, errGitObjectNotFound
+}
+
+func (s *GitObjectStore) ReadCommit(id string) (*GitCommit, error) {
+	objType, data, err := s.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow annotated tags to what they point at
+	for objType == gitObjectTag {
+		target := ""
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "object ") {
+				target = strings.TrimPrefix(line, "object ")
+				break
+			}
+		}
+		if objType, data, err = s.Read(target); err != nil {
+			return nil, err
+		}
+	}
+
+	if objType != gitObjectCommit {
+		return nil, fmt.Errorf("object '%s' is not a commit", id)
+	}
+
+	commit := &GitCommit{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 {
+			// End of headers
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(line, "tree "):
+			commit.Tree = strings.TrimPrefix(line, "tree ")
+		case strings.HasPrefix(line, "parent "):
+			commit.Parents = append(commit.Parents, strings.TrimPrefix(line, "parent "))
+		case strings.HasPrefix(line, "committer "):
+			// committer Name <email> <time> <tz>
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				commit.CommitterTime, _ = strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			}
+		}
+	}
+
+	return commit, nil
+}
+
+// All blobs (and gitlinks) reachable from a tree, keyed by their full path.  Directories whose tree id matches the one
+// in known are skipped, and returned as unchanged instead.
+func (s *GitObjectStore) FlattenTree(id string, known map[string]string) (map[string]GitTreeEntry, map[string]bool, error) {
+	entries := map[string]GitTreeEntry{}
+	unchanged := map[string]bool{}
+	err := s.flattenTree(id, "", known, entries, unchanged)
+	return entries, unchanged, err
+}
+
+func (s *GitObjectStore) flattenTree(id string, dir string, known map[string]string, entries map[string]GitTreeEntry,
+	unchanged map[string]bool) error {
+	if known[dir] == id {
+		unchanged[dir] = true
+		return nil
+	}
+
+	objType, data, err := s.Read(id)
+	if err != nil {
+		return err
+	}
+	if objType != gitObjectTree {
+		return fmt.Errorf("object '%s' is not a tree", id)
+	}
+
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	// <octal mode> <name>\0<20 byte id>
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || nul+21 > len(data) {
+			return fmt.Errorf("malformed tree '%s'", id)
+		}
+
+		mode, err := strconv.ParseUint(string(data[:space]), 8, 32)
+		if err != nil {
+			return err
+		}
+		name := prefix + string(data[space+1:nul])
+		child := hex.EncodeToString(data[nul+1 : nul+21])
+		data = data[nul+21:]
+
+		if mode == 040000 {
+			if err := s.flattenTree(child, name, known, entries, unchanged); err != nil {
+				return err
+			}
+		} else {
+			entries[name] = GitTreeEntry{Mode: uint32(mode), Id: child}
+		}
+	}
+
+	return nil
+}
+
+func readLooseGitObject(path string) (int, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	reader, err := zlib.NewReader(file)
+	if err != nil {
+		return 0, nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// <type> <size>\0<contents>
+	nul := bytes.IndexByte(data, 0)
+	space := bytes.IndexByte(data, ' ')
+	if nul < 0 || space < 0 || space > nul {
+		return 0, nil, fmt.Errorf("malformed loose object '%s'", path)
+	}
+
+	var objType int
+	switch string(data[:space]) {
+	case "commit":
+		objType = gitObjectCommit
+	case "tree":
+		objType = gitObjectTree
+	case "blob":
+		objType = gitObjectBlob
+	case "tag":
+		objType = gitObjectTag
+	default:
+		return 0, nil, fmt.Errorf("unknown object type in '%s'", path)
+	}
+
+	return objType, data[nul+1:], nil
+}
+
+// Offsets into a version 2 pack index: magic, version, 256 entry fan-out, then ids, CRCs, offsets and large offsets
+const (
+	gitPackIndexFanout = 8
+	gitPackIndexIds    = gitPackIndexFanout + 256*4
+)
+
+func readGitPackIndex(path string) (*gitPack, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < gitPackIndexIds {
+		return nil, fmt.Errorf("unsupported pack index '%s'", path)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only version 2 indexes are supported
+	if !bytes.Equal(data[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(data[4:8]) != 2 {
+		_ = syscall.Munmap(data)
+		return nil, fmt.Errorf("unsupported pack index '%s'", path)
+	}
+
+	count := int(binary.BigEndian.Uint32(data[gitPackIndexFanout+255*4:]))
+	if len(data) < gitPackIndexIds+count*(20+4+4) {
+		_ = syscall.Munmap(data)
+		return nil, fmt.Errorf("truncated pack index '%s'", path)
+	}
+
+	return &gitPack{path: strings.TrimSuffix(path, ".idx") + ".pack", index: data, count: count}, nil
+}
+
+func (p *gitPack) id(i int) []byte {
+	return p.index[gitPackIndexIds+i*20 : gitPackIndexIds+(i+1)*20]
+}
+
+// Search between the fan-out bounds for the id's first byte
+func (p *gitPack) find(id [20]byte) (uint64, bool) {
+	low := 0
+	if id[0] > 0 {
+		low = int(binary.BigEndian.Uint32(p.index[gitPackIndexFanout+(int(id[0])-1)*4:]))
+	}
+	high := int(binary.BigEndian.Uint32(p.index[gitPackIndexFanout+int(id[0])*4:]))
+	if low > high || high > p.count {
+		return 0, false
+	}
+
+	i := low + sort.Search(high-low, func(i int) bool {
+		return bytes.Compare(p.id(low+i), id[:]) >= 0
+	})
+	if i >= high || !bytes.Equal(p.id(i), id[:]) {
+		return 0, false
+	}
+
+	offsetStart := gitPackIndexIds + p.count*(20+4)
+	offset := uint64(binary.BigEndian.Uint32(p.index[offsetStart+i*4:]))
+	if offset&0x80000000 != 0 {
+		// Index into the 64-bit offset table
+		large := offsetStart + p.count*4 + int(offset&0x7fffffff)*8
+		if large+8 > len(p.index) {
+			return 0, false
+		}
+		offset = binary.BigEndian.Uint64(p.index[large:])
+	}
+
+	return offset, true
+}
+
+func (s *GitObjectStore) readPacked(pack *gitPack, offset uint64, depth int) (int, []byte, error) {
+	if depth > 50 {
+		return 0, nil, fmt.Errorf("delta chain too deep in '%s'", pack.path)
+	}
+
+	if pack.file == nil {
+		file, err := os.Open(pack.path)
+		if err != nil {
+			return 0, nil, err
+		}
+		pack.file = file
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(pack.file, int64(offset), 1<<62))
+
+	// Type and size header: 3 bits of type, then a size varint
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	objType := int(b>>4) & 7
+	size := uint64(b & 0x0f)
+	shift := uint(4)
+	for b&0x80 != 0 {
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+
+	var baseType int
+	var base []byte
+
+	switch objType {
+	case gitObjectOfsDelta:
+		// Base offset is relative to this object, in a slightly odd varint
+		b, err = reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		relative := uint64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = reader.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			relative = ((relative + 1) << 7) | uint64(b&0x7f)
+		}
+		if relative > offset {
+			return 0, nil, fmt.Errorf("bad delta offset in '%s'", pack.path)
+		}
+		if baseType, base, err = s.readDeltaBase(pack, offset-relative, depth+1); err != nil {
+			return 0, nil, err
+		}
+	case gitObjectRefDelta:
+		var baseId [20]byte
+		if _, err = io.ReadFull(reader, baseId[:]); err != nil {
+			return 0, nil, err
+		}
+		if baseType, base, err = s.Read(hex.EncodeToString(baseId[:])); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	inflater, err := zlib.NewReader(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer inflater.Close()
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(inflater, data); err != nil {
+		return 0, nil, err
+	}
+
+	if objType == gitObjectOfsDelta || objType == gitObjectRefDelta {
+		data, err = applyGitDelta(base, data)
+		return baseType, data, err
+	}
+
+	return objType, data, nil
+}
+
+// Like readPacked, but through the delta base cache
+func (s *GitObjectStore) readDeltaBase(pack *gitPack, offset uint64, depth int) (int, []byte, error) {
+	location := gitPackLocation{pack: pack, offset: offset}
+	if element, ok := s.deltaBases[location]; ok {
+		s.deltaBaseLru.MoveToFront(element)
+		base := element.Value.(*gitDeltaBase)
+		return base.objType, base.data, nil
+	}
+
+	objType, data, err := s.readPacked(pack, offset, depth)
+	if err != nil || len(data) > gitDeltaBaseCacheLimit {
+		return objType, data, err
+	}
+
+	s.deltaBases[location] = s.deltaBaseLru.PushFront(&gitDeltaBase{location: location, objType: objType, data: data})
+	s.deltaBaseBytes += len(data)
+	for s.deltaBaseBytes > gitDeltaBaseCacheLimit {
+		oldest := s.deltaBaseLru.Remove(s.deltaBaseLru.Back()).(*gitDeltaBase)
+		delete(s.deltaBases, oldest.location)
+		s.deltaBaseBytes -= len(oldest.data)
+	}
+
+	return objType, data, nil
+}
+
+func applyGitDelta(base []byte, delta []byte) ([]byte, error) {
+	readVarint := func() uint64 {
+		var value uint64
+		var shift uint
+		for len(delta) > 0 {
+			b := delta[0]
+			delta = delta[1:]
+			value |= uint64(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return value
+	}
+
+	baseSize := readVarint()
+	resultSize := readVarint()
+	if baseSize != uint64(len(base)) {
+		return nil, errors.New("delta base size mismatch")
+	}
+
+	result := make([]byte, 0, resultSize)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 != 0 {
+			// Copy from base: which offset/size bytes are present is flagged in op
+			var copyOffset, copySize uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errors.New("truncated delta")
+				}
+				if i < 4 {
+					copyOffset |= uint64(delta[0]) << (8 * i)
+				} else {
+					copySize |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if copySize == 0 {
+				copySize = 0x10000
+			}
+			if copyOffset+copySize > uint64(len(base)) {
+				return nil, errors.New("delta copy out of range")
+			}
+			result = append(result, base[copyOffset:copyOffset+copySize]...)
+		} else if op != 0 {
+			// Insert literal data
+			if int(op) > len(delta) {
+				return nil, errors.New("truncated delta")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+		} else {
+			return nil, errors.New("invalid delta opcode")
+		}
+	}
+
+	if uint64(len(result)) != resultSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A delta header: the base and result sizes as little-endian base 128 varints
+func gitDeltaHeader(baseSize int, resultSize int) []byte {
+	header := []byte{}
+	for _, size := range []int{baseSize, resultSize} {
+		for size >= 0x80 {
+			header = append(header, byte(size&0x7f)|0x80)
+			size >>= 7
+		}
+		header = append(header, byte(size))
+	}
+	return header
+}
+
+func TestApplyGitDelta(t *testing.T) {
+	base := []byte("The quick brown fox")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 0x1000+32)
+
+	tests := []struct {
+		name   string
+		base   []byte
+		delta  []byte
+		result []byte
+	}{
+		{"copy everything", base, append(gitDeltaHeader(19, 19), 0x90, 19), base},
+		{"insert only", base, append(gitDeltaHeader(19, 3), 0x03, 'a', 'b', 'c'), []byte("abc")},
+		{"insert and copies", base, append(gitDeltaHeader(19, 11),
+			0x01, 'A', // insert "A"
+			0x91, 3, 7, // copy " quick " from offset 3
+			0x91, 16, 3), // copy "fox" from offset 16
+			[]byte("A quick fox")},
+		{"two byte offset", large, append(gitDeltaHeader(len(large), 4), 0x93, 0x04, 0x01, 4), large[0x104:0x108]},
+		{"two byte size", large, append(gitDeltaHeader(len(large), 0x120), 0xb0, 0x20, 0x01), large[:0x120]},
+		{"zero size means 0x10000", large, append(gitDeltaHeader(len(large), 0x10000), 0x80), large[:0x10000]},
+		{"empty result", base, gitDeltaHeader(19, 0), []byte{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := applyGitDelta(test.base, test.delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, test.result) {
+				t.Errorf("Got %q, expected %q", result, test.result)
+			}
+		})
+	}
+}
+
+func TestApplyGitDeltaErrors(t *testing.T) {
+	base := []byte("The quick brown fox")
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"base size mismatch", append(gitDeltaHeader(18, 19), 0x90, 19)},
+		{"result size mismatch", append(gitDeltaHeader(19, 20), 0x90, 19)},
+		{"truncated insert", append(gitDeltaHeader(19, 5), 0x05, 'a', 'b')},
+		{"truncated copy", append(gitDeltaHeader(19, 5), 0x91, 3)},
+		{"copy out of range", append(gitDeltaHeader(19, 5), 0x91, 16, 5)},
+		{"reserved opcode", append(gitDeltaHeader(19, 1), 0x00, 'a')},
+	}
+
+	for _, test := range tests {
+		if _, err := applyGitDelta(base, test.delta); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+/**
+ * Unfinished git operations (merge, rebase, cherry-pick, ...) and stashes, from what git leaves in .git
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Returns nil when nothing is in progress
+func readGitOperation(gitDir string) *RepoOperation {
+	if dir := filepath.Join(gitDir, "rebase-merge"); fileExists(dir) {
+		return &RepoOperation{
+			Name:   "rebasing",
+			Step:   readGitStateInt(filepath.Join(dir, "msgnum")),
+			Total:  readGitStateInt(filepath.Join(dir, "end")),
+			Branch: readGitHeadName(filepath.Join(dir, "head-name")),
+		}
+	}
+
+	if dir := filepath.Join(gitDir, "rebase-apply"); fileExists(dir) {
+		operation := &RepoOperation{
+			Name:  "rebasing",
+			Step:  readGitStateInt(filepath.Join(dir, "next")),
+			Total: readGitStateInt(filepath.Join(dir, "last")),
+		}
+		if fileExists(filepath.Join(dir, "applying")) {
+			operation.Name = "applying-mailbox"
+		} else {
+			operation.Branch = readGitHeadName(filepath.Join(dir, "head-name"))
+		}
+		return operation
+	}
+
+	markers := []struct {
+		file string
+		name string
+	}{
+		{"MERGE_HEAD", "merging"},
+		{"CHERRY_PICK_HEAD", "cherry-picking"},
+		{"REVERT_HEAD", "reverting"},
+		{"BISECT_LOG", "bisecting"},
+	}
+
+	for _, marker := range markers {
+		if fileExists(filepath.Join(gitDir, marker.file)) {
+			return &RepoOperation{Name: marker.name}
+		}
+	}
+
+	return nil
+}
+
+func readGitStateInt(path string) int {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+	return value
+}
+
+// The branch being rebased, e.g. "refs/heads/topic" -> "topic"
+func readGitHeadName(path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSpace(string(contents))
+	if name == "detached HEAD" {
+		return ""
+	}
+	return strings.TrimPrefix(name, "refs/heads/")
+}
+
+// Stashes are the reflog of refs/stash, newest last; returns the count and the newest message
+func readGitStash(commonDir string) (int, string) {
+	contents, err := ioutil.ReadFile(filepath.Join(commonDir, "logs", "refs", "stash"))
+	if err != nil {
+		return 0, ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return 0, ""
+	}
+
+	message := ""
+	if tab := strings.Index(lines[len(lines)-1], "\t"); tab >= 0 {
+		message = lines[len(lines)-1][tab+1:]
+	}
+
+	return len(lines), message
+}
@@ -0,0 +1,193 @@
+package main
+
+/**
+ * Parser for `git status --porcelain=v2 --branch -z`
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type GitPorcelainStatus struct {
+	Oid             string
+	Head            string
+	Detached        bool
+	Upstream        string
+	HasAheadBehind  bool
+	Ahead           int
+	Behind          int
+	Files           []RepoFileStatus
+	HasUnmerged     bool
+	HasUntracked    bool
+	HasUnstaged     bool
+	HasStaged       bool
+	HasInitialState bool
+}
+
+func parseGitPorcelainV2(output string) (*GitPorcelainStatus, error) {
+	status := &GitPorcelainStatus{Files: []RepoFileStatus{}}
+
+	records := strings.Split(output, "\x00")
+
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+
+		if len(record) == 0 {
+			continue
+		}
+
+		switch record[0] {
+		case '#':
+			if err := status.parseHeader(record); err != nil {
+				return nil, err
+			}
+			break
+		case '1':
+			// 1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+			fields := strings.SplitN(record, " ", 9)
+			if len(fields) != 9 {
+				return nil, fmt.Errorf("malformed ordinary entry: '%s'", record)
+			}
+			status.addTracked(RepoFileStatus{Path: fields[8], Code: fields[1], Submodule: submoduleField(fields[2])})
+			break
+		case '2':
+			// 2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <X><score> <path>\0<origPath>
+			fields := strings.SplitN(record, " ", 10)
+			if len(fields) != 10 || i+1 >= len(records) {
+				return nil, fmt.Errorf("malformed rename/copy entry: '%s'", record)
+			}
+			i++
+			status.addTracked(RepoFileStatus{Path: fields[9], OrigPath: records[i], Code: fields[1], Submodule: submoduleField(fields[2])})
+			break
+		case 'u':
+			// u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+			fields := strings.SplitN(record, " ", 11)
+			if len(fields) != 11 {
+				return nil, fmt.Errorf("malformed unmerged entry: '%s'", record)
+			}
+			status.HasUnmerged = true
+			status.Files = append(status.Files, RepoFileStatus{Path: fields[10], Code: fields[1], Submodule: submoduleField(fields[2])})
+			break
+		case '?':
+			status.HasUntracked = true
+			status.Files = append(status.Files, RepoFileStatus{Path: strings.TrimPrefix(record, "? "), Code: "??"})
+			break
+		case '!':
+			status.Files = append(status.Files, RepoFileStatus{Path: strings.TrimPrefix(record, "! "), Code: "!!"})
+			break
+		default:
+			return nil, fmt.Errorf("unknown status entry: '%s'", record)
+		}
+	}
+
+	return status, nil
+}
+
+func (s *GitPorcelainStatus) parseHeader(record string) error {
+	fields := strings.SplitN(record, " ", 3)
+	if len(fields) < 3 {
+		// Headers we don't care about, or ones with no value
+		return nil
+	}
+
+	value := fields[2]
+
+	switch fields[1] {
+	case "branch.oid":
+		if value == "(initial)" {
+			s.HasInitialState = true
+		} else {
+			s.Oid = value
+		}
+		break
+	case "branch.head":
+		if value == "(detached)" {
+			s.Detached = true
+		} else {
+			s.Head = value
+		}
+		break
+	case "branch.upstream":
+		s.Upstream = value
+		break
+	case "branch.ab":
+		var err error
+		counts := strings.Fields(value)
+		if len(counts) != 2 {
+			return fmt.Errorf("malformed ahead/behind header: '%s'", record)
+		}
+		if s.Ahead, err = strconv.Atoi(strings.TrimPrefix(counts[0], "+")); err != nil {
+			return err
+		}
+		if s.Behind, err = strconv.Atoi(strings.TrimPrefix(counts[1], "-")); err != nil {
+			return err
+		}
+		s.HasAheadBehind = true
+		break
+	}
+
+	return nil
+}
+
+func (s *GitPorcelainStatus) addTracked(file RepoFileStatus) {
+	if len(file.Code) == 2 {
+		if file.Code[0] != '.' {
+			s.HasStaged = true
+		}
+		if file.Code[1] != '.' {
+			s.HasUnstaged = true
+		}
+	}
+
+	s.Files = append(s.Files, file)
+}
+
+// Only keep the submodule field when the entry actually is a submodule
+func submoduleField(sub string) string {
+	if strings.HasPrefix(sub, "S") {
+		return sub
+	}
+	return ""
+}
+
+// The branch name, or just "HEAD" when detached (the commit is shown separately)
+func (s *GitPorcelainStatus) BranchName() string {
+	if s.Detached {
+		return "HEAD"
+	}
+	return s.Head
+}
+
+// Tracking information in the same layout as the `##` line of `git status -s -b`
+func (s *GitPorcelainStatus) TrackingInfo(r *Renderer) AnsiString {
+	var branch string
+	if s.Detached {
+		branch = "HEAD (no branch)"
+	} else if s.HasInitialState {
+		branch = "No commits yet on " + s.Head
+	} else {
+		branch = s.Head
+	}
+
+	return buildTrackingInfo(branch, s.Upstream, s.Ahead, s.Behind, s.Upstream != "" && !s.HasAheadBehind, r)
+}
+
+// Count each status key present in a file's status code, once per file
+func (s *GitPorcelainStatus) CountStatus(codes *RepoChangeStatusVCSFields) map[rune]int {
+	status := make(map[rune]int, len(codes.StatusCodes))
+	for field := range codes.StatusCodes {
+		status[field] = 0
+	}
+
+	for _, file := range s.Files {
+		for key := range status {
+			if key != StashStatusCode && strings.ContainsRune(file.Code, key) {
+				status[key]++
+			}
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,94 @@
+package main
+
+/**
+ * Submodule awareness: the superproject of a submodule, and the state of a superproject's submodules
+ */
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type GitSubmodules struct {
+	Dirty         []string `json:"dirty"`
+	NewCommits    []string `json:"new_commits"`
+	Uninitialized []string `json:"uninitialized"`
+}
+
+// Submodule paths from .gitmodules, relative to root
+func readGitSubmodulePaths(root string) []string {
+	modules := GitConfig{}
+	if err := modules.readFile(filepath.Join(root, ".gitmodules"), 0); err != nil {
+		return nil
+	}
+
+	paths := []string{}
+	for key, values := range modules {
+		if strings.HasPrefix(key, "submodule.") && strings.HasSuffix(key, ".path") && len(values) > 0 {
+			paths = append(paths, values[len(values)-1])
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// The repository root that lists root as one of its submodules
+func findGitSuperproject(root string) (string, bool) {
+	parent := filepath.Dir(root)
+	if parent == root {
+		return "", false
+	}
+
+	superRoot, _, found := findGitRoot(parent)
+	if !found {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(superRoot, root)
+	if err != nil {
+		return "", false
+	}
+
+	for _, submodule := range readGitSubmodulePaths(superRoot) {
+		if path.Clean(submodule) == filepath.ToSlash(rel) {
+			return superRoot, true
+		}
+	}
+
+	return "", false
+}
+
+// Which submodules have changes, from the "S<c><m><u>" submodule state of each changed file, plus
+// the ones never checked out (which git status says nothing about).  nil when there are no submodules.
+func summarizeGitSubmodules(root string, files []RepoFileStatus) *GitSubmodules {
+	paths := readGitSubmodulePaths(root)
+	if len(paths) == 0 {
+		return nil
+	}
+
+	summary := &GitSubmodules{Dirty: []string{}, NewCommits: []string{}, Uninitialized: []string{}}
+
+	for _, file := range files {
+		if len(file.Submodule) != 4 {
+			continue
+		}
+		if file.Submodule[1] == 'C' {
+			summary.NewCommits = append(summary.NewCommits, file.Path)
+		}
+		if file.Submodule[2] == 'M' || file.Submodule[3] == 'U' {
+			summary.Dirty = append(summary.Dirty, file.Path)
+		}
+	}
+
+	for _, submodule := range paths {
+		dir := filepath.Join(root, filepath.FromSlash(submodule))
+		if fileExists(dir) && !fileExists(filepath.Join(dir, ".git")) {
+			summary.Uninitialized = append(summary.Uninitialized, submodule)
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,89 @@
+package main
+
+/**
+ * Worktree awareness: the main worktree, which linked worktree we're in, and what the others have checked out
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type GitWorktree struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Branch string `json:"branch,omitempty"`
+	// Short commit id, when HEAD is detached
+	Detached string `json:"detached,omitempty"`
+}
+
+// The main worktree's path; empty for bare repositories
+func gitMainWorktree(commonDir string, config GitConfig) string {
+	if worktree, ok := config.Get("core.worktree"); ok {
+		if !filepath.IsAbs(worktree) {
+			worktree = filepath.Join(commonDir, worktree)
+		}
+		return filepath.Clean(worktree)
+	}
+
+	if filepath.Base(commonDir) == ".git" {
+		return filepath.Dir(commonDir)
+	}
+
+	return ""
+}
+
+// Every worktree except the one whose git directory is gitDir, main worktree first
+func listOtherGitWorktrees(gitDir string, mainPath string) []GitWorktree {
+	commonDir := gitCommonDir(gitDir)
+	worktrees := []GitWorktree{}
+
+	if filepath.Clean(gitDir) != commonDir && mainPath != "" {
+		worktrees = append(worktrees, readGitWorktree(commonDir, mainPath, filepath.Base(mainPath)))
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(commonDir, "worktrees"))
+	if err != nil {
+		return worktrees
+	}
+
+	linked := []GitWorktree{}
+	for _, entry := range entries {
+		dir := filepath.Join(commonDir, "worktrees", entry.Name())
+		if !entry.IsDir() || dir == filepath.Clean(gitDir) {
+			continue
+		}
+
+		// "gitdir" holds the path of the worktree's .git file
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "gitdir"))
+		if err != nil {
+			continue
+		}
+		path := filepath.Dir(strings.TrimSpace(string(contents)))
+
+		linked = append(linked, readGitWorktree(dir, path, entry.Name()))
+	}
+
+	sort.Slice(linked, func(i, j int) bool { return linked[i].Name < linked[j].Name })
+
+	return append(worktrees, linked...)
+}
+
+func readGitWorktree(gitDir string, path string, name string) GitWorktree {
+	worktree := GitWorktree{Path: path, Name: name}
+
+	ref, id, err := readGitHead(gitDir)
+	if err != nil {
+		return worktree
+	}
+
+	if ref != "" {
+		worktree.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	} else if len(id) >= 7 {
+		worktree.Detached = id[:7]
+	}
+
+	return worktree
+}
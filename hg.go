@@ -8,56 +8,127 @@ package main
  */
 
 import (
-	"github.com/fatih/color"
+	"context"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func NewMercurialRepoInfo(workingDirectory *string) *RepoInfo {
-	codes := RepoChangeStatusFieldDefinitions["hg"]
+var hgRemoteIncomingRegexp = regexp.MustCompile(`(\d+)(?: or more)? incoming`)
+var hgRemoteOutgoingRegexp = regexp.MustCompile(`(\d+) outgoing`)
 
-	// Is this a hg repo
-	output, exitCode, err := execAndGetOutput("findup", workingDirectory, ".hg")
+// Branch cache entries: "<node> <o|c> <branch>", o for open heads and c for closed ones
+var hgBranchCacheRegexp = regexp.MustCompile(`^[0-9a-f]{40} ([oc]) (.+)$`)
 
-	if err != nil {
-		// Error
-		return nil
-	} else if exitCode == 1 {
+// Branch caches for each repository filter, most complete first
+var hgBranchCacheFiles = []string{"branch2-served", "branch2-visible", "branch2-immutable", "branch2-base", "branch2",
+	"branch3-served", "branch3-visible", "branch3-immutable", "branch3-base"}
+
+type hgBackend struct{}
+
+func init() {
+	registerBackend(hgBackend{}, RepoChangeStatusVCSFields{VCS: "hg", StatusCodes: HgRepoChangeStatusFieldDefinitions,
+		OrderedKeys: []rune{'M', 'A', 'R', 'C', '!', '?', 'I', '$'}})
+}
+
+func (hgBackend) Name() string {
+	return "hg"
+}
+
+func (hgBackend) Detect(dir string) (Detection, bool) {
+	return Detection{Root: dir, Confidence: 1}, fileExists(filepath.Join(dir, ".hg"))
+}
+
+func (hgBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	return NewMercurialRepoInfo(ctx, &req.Directory, req.Remote, r)
+}
+
+func NewMercurialRepoInfo(ctx context.Context, workingDirectory *string, remote bool, r *Renderer) *RepoInfo {
+	config := currentConfig()
+	codes := config.Fields("hg")
+
+	// Is this a hg repo
+	root, found := findParentWith(*workingDirectory, ".hg")
+	if !found {
 		// .hg folder not found
 		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
-	} else if exitCode != 0 {
-		// Some other kind of error
-		return nil
 	}
 
-	vcscolor := color.New(color.FgHiCyan)
-	root := strings.TrimSpace(output)
+	vcscolor := config.Color("vcs")
 
 	info := &RepoInfo{
 		IsRepo:   true,
-		VCS:      AnsiString{Plain: codes.VCS, Colored: vcscolor.Sprint(codes.VCS)},
+		VCS:      AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)},
 		VCSColor: vcscolor,
 		RepoPath: root,
 		RepoName: path.Base(root),
 	}
 
-	// Go do a hg summary in that folder (TODO: This was super slow, for not don't implement)
-	//output, exitCode, err = execAndGetOutput("hg", workingDirectory, "summary", "--remote")
-
 	// Figure out branch status
-	branchColor := color.New(color.FgGreen)
+	branchColor := config.Color("branch_clean")
+
+	info.Operation = readHgOperation(root)
+	if info.Operation != nil {
+		branchColor = config.Color("branch_merging")
+	}
 
-	// Figure out branches (TODO: Not fully implemented)
-	info.OtherBranches = []AnsiString{} // not implemented
+	// Figure out branches; no .hg/branch means the default branch
 	branchBytes, branchErr := ioutil.ReadFile(info.RepoPath + "/.hg/branch")
 	var branch string
-	if branchErr != nil {
+	if os.IsNotExist(branchErr) {
+		branch = "default"
+	} else if branchErr != nil {
 		branch = "!branch!"
 	} else {
 		branch = strings.TrimSpace(string(branchBytes))
 	}
-	info.BranchName = AnsiString{Plain: branch, Colored: branchColor.Sprint(branch)}
+	info.BranchName = AnsiString{Plain: branch, Colored: r.Sprint(branchColor, branch)}
+	info.IsDefaultBranch = branch == "default" || config.IsMainBranch(branch)
+
+	info.OtherBranches = []AnsiString{}
+	for _, other := range readHgBranches(root) {
+		if other != branch {
+			info.OtherBranches = append(info.OtherBranches, AnsiString{Plain: other, Colored: r.Sprint(config.Color("other_branch"), other)})
+		}
+	}
+
+	// Bookmarks, and the active one
+	active := readHgActiveBookmark(root)
+	if active != "" {
+		info.ActiveBookmark = AnsiString{Plain: active, Colored: r.Sprint(branchColor, active)}
+	}
+	for _, bookmark := range readHgBookmarks(root) {
+		if bookmark != active {
+			info.Bookmarks = append(info.Bookmarks, AnsiString{Plain: bookmark, Colored: r.Sprint(config.Color("bookmark"), bookmark)})
+		}
+	}
+
+	// Outgoing (ahead) and incoming (behind) against the default path.  Asking the remote is slow, so
+	// it's opt-in (or done in the background by the daemon); otherwise unpublished (draft) ancestors of
+	// the working directory count as outgoing, and incoming is unknown.
+	if readHgDefaultPath(root) != "" {
+		info.Upstream = "default"
+		checked := false
+		if activeHgRemoteTracker != nil {
+			info.Ahead, info.Behind, checked = activeHgRemoteTracker.Lookup(root)
+		} else if remote {
+			output, _, err := execAndGetOutputContext(ctx, "hg", workingDirectory, "summary", "--remote")
+			if err == nil {
+				info.Ahead, info.Behind = parseHgRemoteSummary(output)
+				checked = true
+			}
+		}
+		if !checked {
+			info.Ahead = countHgDraftAncestors(ctx, workingDirectory)
+		}
+	}
+	info.BranchTrackingInfo = buildTrackingInfo(branch, info.Upstream, info.Ahead, info.Behind, false, r)
 
 	// Get per-file status, as well as tracking info
 
@@ -66,7 +137,8 @@ func NewMercurialRepoInfo(workingDirectory *string) *RepoInfo {
 		status[field] = 0
 	}
 
-	output, _, err = execAndGetOutput("hg", workingDirectory, "status")
+	output, _, _ := execAndGetOutputContext(ctx, "hg", workingDirectory, "status")
+	timedOut := ctx.Err() != nil
 
 	lines := strings.Split(output, "\n")
 
@@ -82,16 +154,161 @@ func NewMercurialRepoInfo(workingDirectory *string) *RepoInfo {
 
 		// File status
 		for key := range status {
-			if strings.ContainsRune(statchars, key) {
+			if key != StashStatusCode && strings.ContainsRune(statchars, key) {
 				status[key]++
 			}
 		}
 	}
 
+	info.StashCount, info.StashMessage = readHgShelves(root)
+	status[StashStatusCode] = info.StashCount
+
 	info.ChangeStatusCounts = status
-	colorStatus := buildColoredStatusStringFromMap(status, &codes)
+	colorStatus := buildColoredStatusStringFromMap(status, &codes, r)
 
 	info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
 
+	if timedOut {
+		markTimedOut(info, r)
+	}
+
 	return info
 }
+
+// The [paths] default entry from the repository's hgrc
+func readHgDefaultPath(root string) string {
+	contents, err := ioutil.ReadFile(root + "/.hg/hgrc")
+	if err != nil {
+		return ""
+	}
+
+	section := ""
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if eq := strings.Index(line, "="); eq >= 0 && section == "paths" {
+			if strings.TrimSpace(line[:eq]) == "default" {
+				return strings.TrimSpace(line[eq+1:])
+			}
+		}
+	}
+
+	return ""
+}
+
+// Draft changesets haven't been pushed to a publishing repository, so they approximate outgoing without the network
+func countHgDraftAncestors(ctx context.Context, workingDirectory *string) int {
+	output, exitCode, err := execAndGetOutputContext(ctx, "hg", workingDirectory, "log", "--rev", "draft() and ::.", "--template", "x")
+	if err != nil || exitCode != 0 {
+		return 0
+	}
+	return len(strings.TrimSpace(output))
+}
+
+// Outgoing and incoming counts from the "remote:" line of `hg summary --remote`
+func parseHgRemoteSummary(output string) (outgoing int, incoming int) {
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "remote:") {
+			continue
+		}
+
+		if match := hgRemoteIncomingRegexp.FindStringSubmatch(line); match != nil {
+			incoming, _ = strconv.Atoi(match[1])
+		}
+		if match := hgRemoteOutgoingRegexp.FindStringSubmatch(line); match != nil {
+			outgoing, _ = strconv.Atoi(match[1])
+		}
+	}
+
+	return
+}
+
+// Shelves live in .hg/shelved as <name>.patch (plus .hg/.shelve); returns the count and the newest name
+func readHgShelves(root string) (int, string) {
+	files, err := ioutil.ReadDir(root + "/.hg/shelved")
+	if err != nil {
+		return 0, ""
+	}
+
+	count := 0
+	newest := ""
+	var newestTime time.Time
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".patch") {
+			continue
+		}
+
+		count++
+		if newest == "" || file.ModTime().After(newestTime) {
+			newest = strings.TrimSuffix(file.Name(), ".patch")
+			newestTime = file.ModTime()
+		}
+	}
+
+	return count, newest
+}
+
+// Names of branches with open heads, from the branch cache (which hg keeps up to date on commit)
+func readHgBranches(root string) []string {
+	for _, file := range hgBranchCacheFiles {
+		contents, err := ioutil.ReadFile(root + "/.hg/cache/" + file)
+		if err != nil {
+			continue
+		}
+
+		seen := map[string]bool{}
+		branches := []string{}
+		for _, line := range strings.Split(string(contents), "\n") {
+			match := hgBranchCacheRegexp.FindStringSubmatch(line)
+			if match == nil || match[1] != "o" || seen[match[2]] {
+				continue
+			}
+			seen[match[2]] = true
+			branches = append(branches, match[2])
+		}
+
+		sort.Strings(branches)
+		return branches
+	}
+
+	return nil
+}
+
+// Bookmark names from "<node> <name>" lines; newer repositories keep them in the store
+func readHgBookmarks(root string) []string {
+	contents, err := ioutil.ReadFile(root + "/.hg/bookmarks")
+	if os.IsNotExist(err) {
+		contents, err = ioutil.ReadFile(root + "/.hg/store/bookmarks")
+	}
+	if err != nil {
+		return nil
+	}
+
+	bookmarks := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if space := strings.Index(line, " "); space >= 0 {
+			bookmarks = append(bookmarks, strings.TrimSpace(line[space+1:]))
+		}
+	}
+
+	sort.Strings(bookmarks)
+	return bookmarks
+}
+
+func readHgActiveBookmark(root string) string {
+	contents, err := ioutil.ReadFile(root + "/.hg/bookmarks.current")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
@@ -0,0 +1,66 @@
+package main
+
+/**
+ * Unfinished mercurial operations (merge, graft, rebase, ...), from the dirstate and state files in .hg
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const hgDirstateV2Marker = "dirstate-v2\n"
+
+// Returns nil when nothing is in progress
+func readHgOperation(root string) *RepoOperation {
+	hgDir := filepath.Join(root, ".hg")
+
+	// Most of these leave a second dirstate parent too, so check them before merges
+	markers := []struct {
+		file string
+		name string
+	}{
+		{"shelvedstate", "unshelving"},
+		{"histedit-state", "histediting"},
+		{"rebasestate", "rebasing"},
+		{"graftstate", "grafting"},
+	}
+
+	for _, marker := range markers {
+		if fileExists(filepath.Join(hgDir, marker.file)) {
+			return &RepoOperation{Name: marker.name}
+		}
+	}
+
+	if hasHgSecondParent(hgDir) {
+		return &RepoOperation{Name: "merging"}
+	}
+
+	return nil
+}
+
+// The dirstate starts with the working directory's parents: 20 byte node ids in v1, padded to 32 bytes
+// after a marker in v2.  A second parent that isn't the null id means an uncommitted merge.
+func hasHgSecondParent(hgDir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(hgDir, "dirstate"))
+	if err != nil {
+		return false
+	}
+
+	var p2 []byte
+	if bytes.HasPrefix(data, []byte(hgDirstateV2Marker)) {
+		start := len(hgDirstateV2Marker) + 32
+		if len(data) < start+20 {
+			return false
+		}
+		p2 = data[start : start+20]
+	} else {
+		if len(data) < 40 {
+			return false
+		}
+		p2 = data[20:40]
+	}
+
+	return !bytes.Equal(p2, make([]byte, 20))
+}
@@ -0,0 +1,121 @@
+package main
+
+/**
+ * Mercurial incoming/outgoing counts from `hg summary --remote`, refreshed in the background by the daemon
+ */
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type hgRemoteCounts struct {
+	outgoing   int
+	incoming   int
+	checked    time.Time
+	requested  time.Time
+	refreshing bool
+}
+
+// Roots not looked up for this many intervals are forgotten
+const hgRemoteIdleIntervals = 10
+
+type HgRemoteTracker struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	counts   map[string]*hgRemoteCounts
+	onChange func(root string)
+}
+
+// Set by the daemon when --remote-refresh is given
+var activeHgRemoteTracker *HgRemoteTracker
+
+func NewHgRemoteTracker(interval time.Duration, onChange func(root string)) *HgRemoteTracker {
+	tracker := &HgRemoteTracker{
+		interval: interval,
+		counts:   map[string]*hgRemoteCounts{},
+		onChange: onChange,
+	}
+
+	go tracker.refreshPeriodically()
+
+	return tracker
+}
+
+// Cached responses don't call Lookup, so every repository looked up recently is refreshed on a timer too
+func (t *HgRemoteTracker) refreshPeriodically() {
+	for range time.Tick(t.interval) {
+		var forgotten []string
+
+		t.mutex.Lock()
+		for root, counts := range t.counts {
+			if !counts.refreshing && time.Since(counts.requested) >= hgRemoteIdleIntervals*t.interval {
+				delete(t.counts, root)
+				forgotten = append(forgotten, root)
+				continue
+			}
+			if !counts.refreshing && time.Since(counts.checked) >= t.interval {
+				counts.refreshing = true
+				go t.refresh(root)
+			}
+		}
+		t.mutex.Unlock()
+
+		// Cached responses don't look the counts up, so drop them to be looked up (and tracked) again if needed
+		for _, root := range forgotten {
+			if t.onChange != nil {
+				t.onChange(root)
+			}
+		}
+	}
+}
+
+// The last known outgoing and incoming counts for a repository, starting a refresh if they're
+// missing or older than the interval.  ok is false until the first refresh finishes.
+func (t *HgRemoteTracker) Lookup(root string) (outgoing int, incoming int, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counts, found := t.counts[root]
+	if !found {
+		counts = &hgRemoteCounts{}
+		t.counts[root] = counts
+	}
+	counts.requested = time.Now()
+
+	if !counts.refreshing && time.Since(counts.checked) >= t.interval {
+		counts.refreshing = true
+		go t.refresh(root)
+	}
+
+	return counts.outgoing, counts.incoming, !counts.checked.IsZero()
+}
+
+func (t *HgRemoteTracker) refresh(root string) {
+	// Don't wait on a hung remote (or a password prompt) past the next refresh
+	ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+	defer cancel()
+
+	output, _, err := execAndGetOutputContext(ctx, "hg", &root, "summary", "--remote")
+	outgoing, incoming := parseHgRemoteSummary(output)
+	if err != nil {
+		log.Printf("Error checking remote for '%s': %s", root, err)
+	}
+
+	t.mutex.Lock()
+	counts := t.counts[root]
+	changed := err == nil && (counts.checked.IsZero() || counts.outgoing != outgoing || counts.incoming != incoming)
+	counts.refreshing = false
+	counts.checked = time.Now()
+	if err == nil {
+		counts.outgoing, counts.incoming = outgoing, incoming
+	}
+	t.mutex.Unlock()
+
+	// Cached responses still have the old counts
+	if changed && t.onChange != nil {
+		t.onChange(root)
+	}
+}
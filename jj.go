@@ -0,0 +1,151 @@
+package main
+
+/**
+ * Jujutsu (jj) Repo Information
+ *
+ * Running jj snapshots the working copy first, so file changes show up in the working-copy change (@).
+ */
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// One line describing @: change id, commit id, then 1/0 flags for description, conflict and empty, then bookmarks
+const jjWorkingCopyTemplate = `change_id.shortest(8) ++ "\t" ++ commit_id.short(8) ++ "\t" ++ ` +
+	`if(description, "1", "0") ++ "\t" ++ if(conflict, "1", "0") ++ "\t" ++ if(empty, "1", "0") ++ "\t" ++ ` +
+	`local_bookmarks.map(|b| b.name()).join(",") ++ "\n"`
+
+// Confident enough to win over a colocated git repository, whose state is misleading
+type jjBackend struct{}
+
+func init() {
+	registerBackend(jjBackend{}, RepoChangeStatusVCSFields{VCS: "jj", StatusCodes: JujutsuRepoChangeStatusFieldDefinitions,
+		OrderedKeys: []rune{'M', 'A', 'D', 'R', 'C'}})
+}
+
+func (jjBackend) Name() string {
+	return "jj"
+}
+
+func (jjBackend) Detect(dir string) (Detection, bool) {
+	return Detection{Root: dir, Confidence: 2}, fileExists(filepath.Join(dir, ".jj"))
+}
+
+func (jjBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	return NewJujutsuRepoInfo(ctx, &req.Directory, r)
+}
+
+type JujutsuInfo struct {
+	ChangeId       string `json:"change_id"`
+	CommitId       string `json:"commit_id"`
+	HasDescription bool   `json:"has_description"`
+	Conflicted     bool   `json:"conflicted"`
+	Empty          bool   `json:"empty"`
+}
+
+func NewJujutsuRepoInfo(ctx context.Context, workingDirectory *string, r *Renderer) *RepoInfo {
+	config := currentConfig()
+	codes := config.Fields("jj")
+
+	root, found := findParentWith(*workingDirectory, ".jj")
+	if !found {
+		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
+	}
+
+	output, exitCode, err := execAndGetOutputContext(ctx, "jj", workingDirectory, "log", "--no-graph", "--color=never",
+		"--revisions", "@", "--template", jjWorkingCopyTemplate)
+	if ctx.Err() != nil {
+		return newTimedOutRepoInfo(codes.VCS, root, r)
+	} else if err != nil || exitCode != 0 {
+		return nil
+	}
+
+	fields := strings.Split(strings.TrimRight(output, "\n"), "\t")
+	if len(fields) != 6 {
+		return nil
+	}
+
+	vcscolor := config.Color("vcs")
+
+	jj := &JujutsuInfo{
+		ChangeId:       fields[0],
+		CommitId:       fields[1],
+		HasDescription: fields[2] == "1",
+		Conflicted:     fields[3] == "1",
+		Empty:          fields[4] == "1",
+	}
+
+	info := &RepoInfo{
+		IsRepo:   true,
+		VCS:      AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)},
+		VCSColor: vcscolor,
+		RepoPath: root,
+		RepoName: path.Base(root),
+		Jujutsu:  jj,
+	}
+
+	if jj.Conflicted {
+		info.Operation = &RepoOperation{Name: "conflicted"}
+	}
+
+	// File changes in @
+	status := make(map[rune]int, len(codes.StatusCodes))
+	for field := range codes.StatusCodes {
+		status[field] = 0
+	}
+
+	output, _, _ = execAndGetOutputContext(ctx, "jj", workingDirectory, "diff", "--color=never", "--revisions", "@", "--summary")
+	timedOut := ctx.Err() != nil
+
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+
+		code := rune(line[0])
+		if _, ok := status[code]; ok {
+			status[code]++
+		}
+	}
+
+	// Figure out branch status: the working-copy change id stands in for the branch
+	branchColor := config.Color("branch_clean")
+	if jj.Conflicted {
+		branchColor = config.Color("branch_merging")
+	} else if !jj.Empty {
+		branchColor = config.Color("branch_unstaged")
+	}
+
+	info.BranchName = AnsiString{Plain: jj.ChangeId, Colored: r.Sprint(branchColor, jj.ChangeId)}
+
+	// Bookmarks pointing at @
+	if fields[5] != "" {
+		for _, bookmark := range strings.Split(fields[5], ",") {
+			info.Bookmarks = append(info.Bookmarks, AnsiString{Plain: bookmark, Colored: r.Sprint(config.Color("bookmark"), bookmark)})
+			if config.IsMainBranch(bookmark) {
+				info.IsDefaultBranch = true
+			}
+		}
+	}
+	if info.IsDefaultBranch {
+		info.VCSColor = config.Color("vcs_main")
+		info.VCS.Colored = r.Sprint(info.VCSColor, info.VCS.Plain)
+	}
+
+	info.OtherBranches = []AnsiString{}
+	info.BranchTrackingInfo = buildTrackingInfo(jj.ChangeId, "", 0, 0, false, r)
+
+	info.ChangeStatusCounts = status
+	colorStatus := buildColoredStatusStringFromMap(status, &codes, r)
+
+	info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
+
+	if timedOut {
+		markTimedOut(info, r)
+	}
+
+	return info
+}
@@ -0,0 +1,119 @@
+package main
+
+/**
+ * Daemon repository loads: concurrent requests for the same repository share one load, and at most a fixed
+ * number of loads run at once
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type repoLoad struct {
+	done chan struct{}
+	info *RepoInfo
+
+	// When the load gives up, zero if it never does
+	deadline time.Time
+}
+
+type RepoLoader struct {
+	mutex    sync.Mutex
+	inFlight map[repoCacheKey]*repoLoad
+
+	// One token per load allowed to run at once, or nil for no limit
+	workers chan struct{}
+}
+
+// Set by the daemon; without it, every request loads on its own
+var activeRepoLoader *RepoLoader
+
+// A workers count of zero (or less) doesn't limit concurrent loads
+func NewRepoLoader(workers int) *RepoLoader {
+	loader := &RepoLoader{
+		inFlight: map[repoCacheKey]*repoLoad{},
+	}
+
+	if workers > 0 {
+		loader.workers = make(chan struct{}, workers)
+	}
+
+	return loader
+}
+
+func (l *RepoLoader) Load(req Request, r *Renderer) *RepoInfo {
+	if l == nil {
+		return loadRepo(req, r)
+	}
+
+	root, _ := findCacheRoot(req)
+	if root == "" {
+		return l.run(req, r)
+	}
+
+	return l.loadShared(newRepoCacheKey(root, req), req, r)
+}
+
+// Wait on a load of the same repository already in flight, or start one.  Requests only share loads that
+// won't give up before they would themselves, and stop waiting when their own timeout passes.
+func (l *RepoLoader) loadShared(key repoCacheKey, req Request, r *Renderer) *RepoInfo {
+	if l == nil {
+		return loadRepo(req, r)
+	}
+
+	ctx, cancel := requestContext(req)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	l.mutex.Lock()
+	load, inFlight := l.inFlight[key]
+	if inFlight && (load.deadline.IsZero() || (!deadline.IsZero() && !load.deadline.Before(deadline))) {
+		l.mutex.Unlock()
+		select {
+		case <-load.done:
+			return load.info
+		case <-ctx.Done():
+			return loadRepoContext(ctx, req, r)
+		}
+	}
+
+	// Loads that give up sooner than one already in flight run on their own
+	load = &repoLoad{done: make(chan struct{}), deadline: deadline}
+	if !inFlight {
+		l.inFlight[key] = load
+	}
+	l.mutex.Unlock()
+
+	load.info = l.runContext(ctx, req, r)
+
+	if !inFlight {
+		l.mutex.Lock()
+		delete(l.inFlight, key)
+		l.mutex.Unlock()
+	}
+	close(load.done)
+
+	return load.info
+}
+
+func (l *RepoLoader) run(req Request, r *Renderer) *RepoInfo {
+	ctx, cancel := requestContext(req)
+	defer cancel()
+
+	return l.runContext(ctx, req, r)
+}
+
+// Load once a worker is free, or without one once ctx is done, since that's quick
+func (l *RepoLoader) runContext(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	if l != nil && l.workers != nil {
+		select {
+		case l.workers <- struct{}{}:
+			defer func() { <-l.workers }()
+		case <-ctx.Done():
+		}
+	}
+
+	return loadRepoContext(ctx, req, r)
+}
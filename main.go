@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/fatih/color"
 	"github.com/pborman/getopt/v2"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"runtime"
 	"strings"
+	"time"
 )
 
 type OutputType int
@@ -17,14 +20,7 @@ const (
 	Full       OutputType = 0
 	Prompt     OutputType = 1
 	StatusLine OutputType = 2
-)
-
-type RepoType int
-
-const (
-	Detect    RepoType = 0
-	Git       RepoType = 1
-	Mercurial RepoType = 2
+	Template   OutputType = 3
 )
 
 type ExecutionType int
@@ -42,8 +38,45 @@ type Request struct {
 	ForceColor  bool
 	Directory   string
 	Output      OutputType
-	Vcs         RepoType
+	Vcs         string
 	StatusCheck bool
+	Arrows      bool
+	Remote      bool
+	Parents     bool
+	Format      string
+	Timeout     time.Duration
+}
+
+// Clients from before backends registered themselves sent the VCS as a number, indexing this
+var legacyVcsNames = []string{DetectBackend, "git", "hg", "gitnative", "jj", "svn", "fossil"}
+
+// Accepts the VCS by name, or by number from older clients
+func (req *Request) UnmarshalJSON(data []byte) error {
+	type plainRequest Request
+	var decoded struct {
+		plainRequest
+		Vcs json.RawMessage
+	}
+
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*req = Request(decoded.plainRequest)
+
+	if len(decoded.Vcs) == 0 || string(decoded.Vcs) == "null" {
+		return nil
+	}
+
+	var number int
+	if err := json.Unmarshal(decoded.Vcs, &number); err == nil {
+		if number < 0 || number >= len(legacyVcsNames) {
+			return fmt.Errorf("unknown vcs number %d", number)
+		}
+		req.Vcs = legacyVcsNames[number]
+		return nil
+	}
+
+	return json.Unmarshal(decoded.Vcs, &req.Vcs)
 }
 
 // Vcs Status Response
@@ -57,6 +90,11 @@ type ExecutionOptions struct {
 	Execution            ExecutionType
 	SocketPath           string
 	ForceSocketOverwrite bool
+	CacheSize            int
+	ConfigPath           string
+	RemoteRefresh        time.Duration
+	ServeStale           bool
+	Workers              int
 }
 
 func parseOptions() (Request, ExecutionOptions, error) {
@@ -66,9 +104,9 @@ func parseOptions() (Request, ExecutionOptions, error) {
 	workingdir := getopt.StringLong("dir", 'd', "",
 		"The working directory to pretend we're in.\nNOTE: Tilde (~) exp    ansion is best-effort and should not be relied on.")
 
-	outputtype := getopt.EnumLong("output", 'o', []string{"full", "prompt", "statusline"}, "full", "Output format")
+	outputtype := getopt.EnumLong("output", 'o', []string{"full", "prompt", "statusline", "template"}, "full", "Output format")
 
-	vcstype := getopt.EnumLong("vcs", 'r', []string{"detect", "git", "hg"}, "detect", "Version Control System")
+	vcstype := getopt.EnumLong("vcs", 'r', append([]string{DetectBackend}, backendNames()...), DetectBackend, "Version Control System")
 
 	exectype := getopt.EnumLong("exec", 'X', []string{"singleuse", "daemon", "client", "daemoncheck", "clientfallback"}, "singleuse", "How to invoke vcsstatus.  Listen for requests as a daemon, connect to a daemon as a client, or run single-use.")
 
@@ -76,14 +114,32 @@ func parseOptions() (Request, ExecutionOptions, error) {
 
 	overwritesocket := getopt.BoolLong("overwritesocket", 'O', "If the socketpath exists, overwrite it.")
 
+	format := getopt.StringLong("format", 'f', "", "Go text/template to render RepoInfo with, for --output=template.")
+
+	formatfile := getopt.StringLong("format-file", 'F', "", "Read the --output=template format from this file.")
+
+	configpath := getopt.StringLong("config", 'C', "", "Configuration file. Defaults to $XDG_CONFIG_HOME/vcsstatus/config")
+
+	cachesize := getopt.IntLong("cachesize", 0, 32, "How many repositories the daemon keeps cached (0 disables caching).")
+
+	workers := getopt.IntLong("workers", 0, runtime.NumCPU(), "How many repositories the daemon loads at once (0 for no limit).")
+
+	arrows := getopt.BoolLong("arrows", 'a', "Show ahead/behind counts as arrows in prompt and statusline output.")
+
+	remote := getopt.BoolLong("remote", 0, "Contact the remote to compute incoming/outgoing counts (hg only, slow).")
+
+	parents := getopt.BoolLong("parents", 0, "List the repositories enclosing this one (full output).")
+
+	timeout := getopt.DurationLong("timeout", 't', 0, "Give up on slow parts of the status after this long, and report what we have (0 waits forever).")
+
+	servestale := getopt.BoolLong("serve-stale", 0, "Have the daemon answer with the last result for a repository that changed, and reload it in the background.")
+
+	remoterefresh := getopt.DurationLong("remote-refresh", 0, 0, "Have the daemon contact remotes in the background this often for incoming/outgoing counts (hg only, 0 disables).")
+
 	// Parse
 
 	getopt.Parse()
 
-	if *forcecolor {
-		color.NoColor = false
-	}
-
 	dir := *workingdir
 
 	if dir == "" {
@@ -105,25 +161,28 @@ func parseOptions() (Request, ExecutionOptions, error) {
 	case "statusline":
 		output = StatusLine
 		break
+	case "template":
+		output = Template
+		break
 	default:
 		return Request{}, ExecutionOptions{}, fmt.Errorf("invalid format passed to --output: '%s'", *outputtype)
 	}
 
-	var vcs RepoType
-	switch *vcstype {
-	case "detect":
-		vcs = Detect
-		break
-	case "git":
-		vcs = Git
-		break
-	case "hg":
-		fallthrough
-	case "mercurial":
-		vcs = Mercurial
-		break
-	default:
-		return Request{}, ExecutionOptions{}, fmt.Errorf("invalid vcs system passed to --vcs: '%s'", *vcstype)
+	templateFormat := *format
+	if *formatfile != "" {
+		contents, err := ioutil.ReadFile(expandTilde(*formatfile))
+		if err != nil {
+			return Request{}, ExecutionOptions{}, err
+		}
+		templateFormat = string(contents)
+	}
+	if output == Template && templateFormat == "" {
+		return Request{}, ExecutionOptions{}, fmt.Errorf("--output=template requires --format or --format-file")
+	}
+
+	vcs := *vcstype
+	if _, ok := backends[vcs]; !ok && vcs != DetectBackend {
+		return Request{}, ExecutionOptions{}, fmt.Errorf("invalid vcs system passed to --vcs: '%s'", vcs)
 	}
 
 	var exec ExecutionType
@@ -147,6 +206,11 @@ func parseOptions() (Request, ExecutionOptions, error) {
 		return Request{}, ExecutionOptions{}, fmt.Errorf("invalid execution type passed to --exec: '%s'", *exectype)
 	}
 
+	config := *configpath
+	if config == "" {
+		config = defaultConfigPath()
+	}
+
 	socket := *socketpath
 	if socket == "" {
 		socket = os.ExpandEnv("$HOME") + "/.vcsstatus-sock"
@@ -157,47 +221,68 @@ func parseOptions() (Request, ExecutionOptions, error) {
 			Directory:  dir,
 			Output:     output,
 			Vcs:        vcs,
+			Arrows:     *arrows,
+			Remote:     *remote,
+			Parents:    *parents,
+			Timeout:    *timeout,
+			Format:     templateFormat,
 		}, ExecutionOptions{
 			Execution:            exec,
 			SocketPath:           socket,
-			ForceSocketOverwrite: *overwritesocket},
+			ForceSocketOverwrite: *overwritesocket,
+			CacheSize:            *cachesize,
+			Workers:              *workers,
+			ConfigPath:           config,
+			RemoteRefresh:        *remoterefresh,
+			ServeStale:           *servestale},
 		nil
 }
 
-func loadRepo(req Request) *RepoInfo {
-	switch req.Vcs {
-	case Git:
-		return NewGitRepoInfo(&req.Directory)
-	case Mercurial:
-		return NewMercurialRepoInfo(&req.Directory)
+// Cancelled once the request's timeout passes, if it has one
+func requestContext(req Request) (context.Context, context.CancelFunc) {
+	if req.Timeout > 0 {
+		return context.WithTimeout(context.Background(), req.Timeout)
 	}
+	return context.WithCancel(context.Background())
+}
+
+func loadRepo(req Request, r *Renderer) *RepoInfo {
+	ctx, cancel := requestContext(req)
+	defer cancel()
+
+	return loadRepoContext(ctx, req, r)
+}
 
-	// cases Detect, default, and other invalid options
-	var info *RepoInfo
+// Once ctx is done, backends report what they can without running anything slow
+func loadRepoContext(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	info := loadInnermostRepo(ctx, req, r)
 
-	// Git first
-	info = NewGitRepoInfo(&req.Directory)
-	if info != nil && info.IsRepo {
-		// It was a git repo
-		return info
+	if req.Parents && info != nil && info.IsRepo {
+		info.ParentRepos = detectParentRepos(info.RepoPath)
 	}
 
-	// Mercurial next
-	info = NewMercurialRepoInfo(&req.Directory)
-	if info != nil && info.IsRepo {
-		// It was a hg repo
-		return info
+	return info
+}
+
+func loadInnermostRepo(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	// Explicitly chosen backends load even when they don't detect anything, to report IsRepo=false
+	if backend, ok := backends[req.Vcs]; ok {
+		return backend.Load(ctx, req, r)
+	}
+
+	// The innermost repository, falling back to others at the same root if its backend fails
+	for _, detection := range detectRepos(req.Directory, DetectBackend) {
+		info := detection.Backend.Load(ctx, req, r)
+		if info != nil && info.IsRepo {
+			return info
+		}
 	}
 
 	// All done
 	return nil
 }
 
-func buildResponse(req Request, info *RepoInfo) Response {
-	// TODO: Color handling isn't thread-safe / handles multiple requests well
-	// TODO: Color support doesn't work the first time w/ daemons
-	color.NoColor = !req.ForceColor
-
+func buildResponse(req Request, info *RepoInfo, r *Renderer) Response {
 	if req.Directory == "" {
 		return Response{ExitCode: 2, Content: "Directory must be non-empty."}
 	}
@@ -209,7 +294,23 @@ func buildResponse(req Request, info *RepoInfo) Response {
 	switch req.Output {
 	case Prompt:
 		var response strings.Builder
-		response.WriteString(fmt.Sprintf("%s%s%s%s", info.VCS.Colored, info.VCSColor.Sprint(":<"), info.BranchName.Colored, info.VCSColor.Sprint(">")))
+		branch := info.BranchName.Colored
+		// As git's own prompt shows them
+		if info.IsBare {
+			branch = r.Sprint(info.VCSColor, "BARE:") + branch
+		} else if info.IsGitDir {
+			branch = r.Sprint(info.VCSColor, "GIT_DIR!")
+		}
+		if info.ActiveBookmark.Plain != "" {
+			branch += r.Sprint(info.VCSColor, "@") + info.ActiveBookmark.Colored
+		}
+		if operation := buildOperationString(info, r); operation != "" {
+			branch += r.Sprint(info.VCSColor, "|") + operation
+		}
+		response.WriteString(fmt.Sprintf("%s%s%s%s", info.VCS.Colored, r.Sprint(info.VCSColor, ":<"), branch, r.Sprint(info.VCSColor, ">")))
+		if arrows := buildTrackingArrows(info, r); req.Arrows && arrows != "" {
+			response.WriteString(" " + arrows)
+		}
 		if len(info.OtherBranches) > 0 {
 			// Get just the colored names
 			branches := []string{}
@@ -218,17 +319,43 @@ func buildResponse(req Request, info *RepoInfo) Response {
 			}
 			response.WriteString(fmt.Sprintf(" {%s}", strings.Join(branches, ", ")))
 		}
+		if superproject := buildSuperprojectString(info, r); superproject != "" {
+			response.WriteString(" " + superproject)
+		}
+		if len(info.Bookmarks) > 0 {
+			bookmarks := []string{}
+			for _, b := range info.Bookmarks {
+				bookmarks = append(bookmarks, b.Colored)
+			}
+			response.WriteString(fmt.Sprintf(" [%s]", strings.Join(bookmarks, ", ")))
+		}
 		response.WriteString("\n")
-		response.WriteString(info.Status.Colored + "\n")
+		response.WriteString(buildStatusWithSubmodules(info, r) + "\n")
 		return Response{ExitCode: 0, Content: response.String()}
 	case StatusLine:
 		var response strings.Builder
 		response.WriteString(info.VCS.Colored + "\n")
-		response.WriteString(info.RepoName + "\n")
-		response.WriteString(info.BranchTrackingInfo.Colored + "\n")
-		response.WriteString(info.Status.Colored + "\n")
+		if info.WorktreeName != "" {
+			response.WriteString(fmt.Sprintf("%s (%s)\n", info.RepoName, info.WorktreeName))
+		} else {
+			response.WriteString(info.RepoName + "\n")
+		}
+		tracking := info.BranchTrackingInfo.Colored
+		if arrows := buildTrackingArrows(info, r); req.Arrows && arrows != "" {
+			tracking = info.Upstream + " " + arrows
+		}
+		if operation := buildOperationString(info, r); operation != "" {
+			tracking += " " + operation
+		}
+		if superproject := buildSuperprojectString(info, r); superproject != "" {
+			tracking += " " + superproject
+		}
+		response.WriteString(tracking + "\n")
+		response.WriteString(buildStatusWithSubmodules(info, r) + "\n")
 		response.WriteString(info.RepoPath + "\n")
 		return Response{ExitCode: 0, Content: response.String()}
+	case Template:
+		return buildTemplateResponse(req.Format, info, r)
 	}
 
 	// Full and default output types
@@ -236,10 +363,15 @@ func buildResponse(req Request, info *RepoInfo) Response {
 	return Response{ExitCode: 0, Content: string(output) + "\n"}
 }
 
-func singleMain(req Request) {
-	info := loadRepo(req)
+func singleMain(req Request, options ExecutionOptions) {
+	if err := loadConfig(options.ConfigPath); err != nil {
+		log.Printf("Using default configuration: %s", err)
+	}
+
+	r := NewRenderer(req.ForceColor)
+	info := loadRepo(req, r)
 
-	response := buildResponse(req, info)
+	response := buildResponse(req, info, r)
 
 	fmt.Print(response.Content)
 	os.Exit(response.ExitCode)
@@ -250,7 +382,7 @@ func clientMain(req Request, options ExecutionOptions) {
 		if options.Execution == ClientWithFallback {
 			log.Printf("Error connecting to '%s': %s", options.SocketPath, err)
 			// Try single use too
-			singleMain(req)
+			singleMain(req, options)
 		} else {
 			log.Fatalf("Error connecting to '%s': %s", options.SocketPath, err)
 		}
@@ -300,7 +432,7 @@ func main() {
 	case SingleUse:
 		fallthrough
 	default:
-		singleMain(req)
+		singleMain(req, options)
 		break
 	}
 }
@@ -0,0 +1,65 @@
+package main
+
+/**
+ * Per-request coloring, so concurrent daemon requests don't share color state
+ */
+
+import (
+	"github.com/fatih/color"
+	"strings"
+)
+
+var colorAttributesByName = map[string]color.Attribute{
+	"black":     color.FgBlack,
+	"red":       color.FgRed,
+	"green":     color.FgGreen,
+	"yellow":    color.FgYellow,
+	"blue":      color.FgBlue,
+	"magenta":   color.FgMagenta,
+	"cyan":      color.FgCyan,
+	"white":     color.FgWhite,
+	"hiblack":   color.FgHiBlack,
+	"hired":     color.FgHiRed,
+	"higreen":   color.FgHiGreen,
+	"hiyellow":  color.FgHiYellow,
+	"hiblue":    color.FgHiBlue,
+	"himagenta": color.FgHiMagenta,
+	"hicyan":    color.FgHiCyan,
+	"hiwhite":   color.FgHiWhite,
+	"bold":      color.Bold,
+	"faint":     color.Faint,
+	"italic":    color.Italic,
+	"underline": color.Underline,
+}
+
+func colorAttributeByName(name string) (color.Attribute, bool) {
+	attribute, ok := colorAttributesByName[strings.ToLower(name)]
+	return attribute, ok
+}
+
+type Renderer struct {
+	Color bool
+}
+
+func NewRenderer(forceColor bool) *Renderer {
+	return &Renderer{Color: forceColor}
+}
+
+// A color that is on or off according to this renderer, regardless of color.NoColor
+func (r *Renderer) New(attributes ...color.Attribute) *color.Color {
+	c := color.New(attributes...)
+	if r.Color {
+		c.EnableColor()
+	} else {
+		c.DisableColor()
+	}
+	return c
+}
+
+func (r *Renderer) Sprint(attribute color.Attribute, a ...interface{}) string {
+	return r.New(attribute).Sprint(a...)
+}
+
+func (r *Renderer) Sprintf(attribute color.Attribute, format string, a ...interface{}) string {
+	return r.New(attribute).Sprintf(format, a...)
+}
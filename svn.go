@@ -0,0 +1,214 @@
+package main
+
+/**
+ * Subversion Repo Information
+ */
+
+import (
+	"context"
+	"encoding/xml"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type svnBackend struct{}
+
+func init() {
+	registerBackend(svnBackend{}, RepoChangeStatusVCSFields{VCS: "svn", StatusCodes: SubversionRepoChangeStatusFieldDefinitions,
+		OrderedKeys: []rune{'M', 'A', 'D', 'R', 'G', 'C', '!', '~', '?', 'I'}})
+}
+
+func (svnBackend) Name() string {
+	return "svn"
+}
+
+func (svnBackend) Detect(dir string) (Detection, bool) {
+	return Detection{Root: dir, Confidence: 1}, fileExists(filepath.Join(dir, ".svn"))
+}
+
+func (svnBackend) Load(ctx context.Context, req Request, r *Renderer) *RepoInfo {
+	return NewSubversionRepoInfo(ctx, &req.Directory, r)
+}
+
+type SubversionInfo struct {
+	URL            string `json:"url"`
+	RepositoryRoot string `json:"repository_root"`
+	Revision       string `json:"revision"`
+}
+
+// The parts of `svn info --xml` we use
+type svnInfoXML struct {
+	Entry struct {
+		Revision    string `xml:"revision,attr"`
+		URL         string `xml:"url"`
+		RelativeURL string `xml:"relative-url"`
+		Repository  struct {
+			Root string `xml:"root"`
+		} `xml:"repository"`
+		WorkingCopy struct {
+			Root string `xml:"wcroot-abspath"`
+		} `xml:"wc-info"`
+	} `xml:"entry"`
+}
+
+// The parts of `svn status --xml` we use
+type svnStatusXML struct {
+	Targets []struct {
+		Entries []struct {
+			Path   string `xml:"path,attr"`
+			Status struct {
+				Item           string `xml:"item,attr"`
+				Props          string `xml:"props,attr"`
+				TreeConflicted string `xml:"tree-conflicted,attr"`
+			} `xml:"wc-status"`
+		} `xml:"entry"`
+	} `xml:"target"`
+}
+
+// The letters `svn status` prints for each item state
+var svnStatusLetters = map[string]rune{
+	"added":       'A',
+	"conflicted":  'C',
+	"deleted":     'D',
+	"external":    'X',
+	"ignored":     'I',
+	"incomplete":  '!',
+	"merged":      'G',
+	"missing":     '!',
+	"modified":    'M',
+	"obstructed":  '~',
+	"replaced":    'R',
+	"unversioned": '?',
+}
+
+func NewSubversionRepoInfo(ctx context.Context, workingDirectory *string, r *Renderer) *RepoInfo {
+	config := currentConfig()
+	codes := config.Fields("svn")
+
+	svnRoot, found := findParentWith(*workingDirectory, ".svn")
+	if !found {
+		return &RepoInfo{IsRepo: false, VCS: AnsiString{Plain: codes.VCS, Colored: codes.VCS}}
+	}
+
+	output, exitCode, err := execAndGetOutputContext(ctx, "svn", workingDirectory, "info", "--xml")
+	if ctx.Err() != nil {
+		return newTimedOutRepoInfo(codes.VCS, svnRoot, r)
+	} else if err != nil || exitCode != 0 {
+		return nil
+	}
+
+	var svnInfo svnInfoXML
+	if err := xml.Unmarshal([]byte(output), &svnInfo); err != nil {
+		return nil
+	}
+
+	vcscolor := config.Color("vcs")
+	root := svnInfo.Entry.WorkingCopy.Root
+
+	info := &RepoInfo{
+		IsRepo:   true,
+		VCS:      AnsiString{Plain: codes.VCS, Colored: r.Sprint(vcscolor, codes.VCS)},
+		VCSColor: vcscolor,
+		RepoPath: root,
+		RepoName: path.Base(root),
+		Subversion: &SubversionInfo{
+			URL:            svnInfo.Entry.URL,
+			RepositoryRoot: svnInfo.Entry.Repository.Root,
+			Revision:       svnInfo.Entry.Revision,
+		},
+	}
+
+	// Per-file status
+	status := make(map[rune]int, len(codes.StatusCodes))
+	for field := range codes.StatusCodes {
+		status[field] = 0
+	}
+
+	// The whole working copy, like the other backends, not just the subtree we're in
+	output, _, _ = execAndGetOutputContext(ctx, "svn", workingDirectory, "status", "--xml", root)
+	timedOut := ctx.Err() != nil
+
+	var svnStatus svnStatusXML
+	if err := xml.Unmarshal([]byte(output), &svnStatus); err != nil && !timedOut {
+		status := "!status!"
+		info.Status = AnsiString{Plain: status, Colored: r.Sprint(config.Color("branch_untracked"), status)}
+	}
+
+	info.Files = []RepoFileStatus{}
+	for _, target := range svnStatus.Targets {
+		for _, entry := range target.Entries {
+			code, ok := svnStatusLetters[entry.Status.Item]
+			if !ok && entry.Status.Props == "modified" {
+				code, ok = 'M', true
+			}
+			if entry.Status.Props == "conflicted" || entry.Status.TreeConflicted == "true" {
+				code, ok = 'C', true
+			}
+			if !ok {
+				continue
+			}
+
+			if _, counted := status[code]; counted {
+				status[code]++
+			}
+			// Paths come back under the target we gave, so make them relative to the root again
+			file := entry.Path
+			if relative, err := filepath.Rel(root, file); err == nil {
+				file = relative
+			}
+			info.Files = append(info.Files, RepoFileStatus{Path: file, Code: string(code)})
+		}
+	}
+
+	// Figure out branch status
+	branchColor := config.Color("branch_clean")
+	if status['C'] > 0 {
+		branchColor = config.Color("branch_merging")
+	} else if status['?'] > 0 {
+		branchColor = config.Color("branch_untracked")
+	} else if len(info.Files) > 0 {
+		branchColor = config.Color("branch_unstaged")
+	}
+
+	branch := svnBranchName(svnInfo.Entry.RelativeURL)
+	info.BranchName = AnsiString{Plain: branch, Colored: r.Sprint(branchColor, branch)}
+	info.IsDefaultBranch = branch == "trunk" || config.IsMainBranch(branch)
+	if info.IsDefaultBranch {
+		info.VCSColor = config.Color("vcs_main")
+		info.VCS.Colored = r.Sprint(info.VCSColor, info.VCS.Plain)
+	}
+
+	info.OtherBranches = []AnsiString{}
+	info.BranchTrackingInfo = buildTrackingInfo(branch+"@"+svnInfo.Entry.Revision, "", 0, 0, false, r)
+
+	info.ChangeStatusCounts = status
+	if info.Status.Plain == "" {
+		colorStatus := buildColoredStatusStringFromMap(status, &codes, r)
+		info.Status = AnsiString{Plain: stripANSI(colorStatus), Colored: colorStatus}
+	}
+
+	if timedOut {
+		markTimedOut(info, r)
+	}
+
+	return info
+}
+
+// The branch from the standard layout: "^/trunk/src" -> "trunk", "^/branches/X/src" -> "X", "^/tags/X" -> "tags/X"
+func svnBranchName(relativeURL string) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(relativeURL, "^"), "/"), "/")
+
+	for i, part := range parts {
+		switch {
+		case part == "trunk":
+			return "trunk"
+		case part == "branches" && i+1 < len(parts):
+			return parts[i+1]
+		case part == "tags" && i+1 < len(parts):
+			return "tags/" + parts[i+1]
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,79 @@
+package main
+
+/**
+ * User-defined output formats, as Go text/templates evaluated against RepoInfo
+ */
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+func buildTemplateFuncs(info *RepoInfo, r *Renderer) template.FuncMap {
+	return template.FuncMap{
+		// {{color "hired" .BranchName.Plain}}
+		"color": func(name string, a ...interface{}) (string, error) {
+			attribute, ok := colorAttributeByName(name)
+			if !ok {
+				return "", fmt.Errorf("unknown color '%s'", name)
+			}
+			return r.Sprint(attribute, a...), nil
+		},
+		// {{.BranchName.Plain | truncate 20}}
+		"truncate": func(length int, s string) string {
+			if length <= 0 || utf8.RuneCountInString(s) <= length {
+				return s
+			}
+			runes := []rune(s)
+			if length == 1 {
+				return "…"
+			}
+			return string(runes[:length-1]) + "…"
+		},
+		// {{if gt (status "M") 0}}...{{end}}
+		"status": func(code string) int {
+			if len(code) == 0 {
+				return 0
+			}
+			key, _ := utf8.DecodeRuneInString(code)
+			return info.ChangeStatusCounts[key]
+		},
+		// {{if dirty}}*{{end}}
+		"dirty": func() bool {
+			for key, count := range info.ChangeStatusCounts {
+				if key != StashStatusCode && count > 0 {
+					return true
+				}
+			}
+			return false
+		},
+		// {{arrows}} renders ahead/behind as ↑2↓1
+		"arrows": func() string {
+			return buildTrackingArrows(info, r)
+		},
+		// {{join ", " .OtherBranches}}
+		"join": func(sep string, items []AnsiString) string {
+			colored := make([]string, 0, len(items))
+			for _, item := range items {
+				colored = append(colored, item.Colored)
+			}
+			return strings.Join(colored, sep)
+		},
+	}
+}
+
+func buildTemplateResponse(format string, info *RepoInfo, r *Renderer) Response {
+	tmpl, err := template.New("format").Funcs(buildTemplateFuncs(info, r)).Parse(format)
+	if err != nil {
+		return Response{ExitCode: 2, Content: fmt.Sprintf("Error parsing format: %s\n", err)}
+	}
+
+	var output strings.Builder
+	if err := tmpl.Execute(&output, info); err != nil {
+		return Response{ExitCode: 2, Content: fmt.Sprintf("Error executing format: %s\n", err)}
+	}
+
+	return Response{ExitCode: 0, Content: output.String()}
+}
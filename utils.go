@@ -6,9 +6,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"syscall"
+	"time"
 )
 
 ////////////////////////////////////////////
@@ -26,7 +31,15 @@ func stripANSI(str string) string {
 ////////////////////////////////////////////
 
 func execAndGetOutput(name string, workingDirectory *string, args ...string) (stdout string, exitCode int, err error) {
-	cmd := exec.Command(name, args...)
+	return execAndGetOutputContext(context.Background(), name, workingDirectory, args...)
+}
+
+// Like execAndGetOutput, but the command is killed when ctx is done, and err is then ctx's error
+func execAndGetOutputContext(ctx context.Context, name string, workingDirectory *string, args ...string) (stdout string, exitCode int, err error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	// Don't wait on children that kept stdout open after the command was killed
+	cmd.WaitDelay = 100 * time.Millisecond
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
@@ -53,5 +66,102 @@ func execAndGetOutput(name string, workingDirectory *string, args ...string) (st
 
 	stdout = out.String()
 
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
 	return
 }
+
+////////////////////////////////////////////
+// Utility: Filesystem
+////////////////////////////////////////////
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Walk up from dir until we find one containing name
+func findParentWith(dir string, name string) (string, bool) {
+	return walkUpFrom(dir, func(current string) bool {
+		return fileExists(filepath.Join(current, name))
+	})
+}
+
+// Walk up from dir until match accepts a directory.  Like git, this won't move up into any of
+// the GIT_CEILING_DIRECTORIES, or onto another filesystem unless GIT_DISCOVERY_ACROSS_FILESYSTEM is set.
+func walkUpFrom(dir string, match func(dir string) bool) (string, bool) {
+	current, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	ceilings := ceilingDirectories()
+	acrossFilesystems := isTruthy(os.Getenv("GIT_DISCOVERY_ACROSS_FILESYSTEM"))
+	device, hasDevice := deviceOf(current)
+
+	for {
+		if match(current) {
+			return current, true
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current || ceilings[parent] {
+			return "", false
+		}
+
+		if !acrossFilesystems && hasDevice {
+			if parentDevice, ok := deviceOf(parent); ok && parentDevice != device {
+				return "", false
+			}
+		}
+
+		current = parent
+	}
+}
+
+// Absolute entries of GIT_CEILING_DIRECTORIES; relative ones are ignored, as git does
+func ceilingDirectories() map[string]bool {
+	ceilings := map[string]bool{}
+
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		if filepath.IsAbs(dir) {
+			ceilings[filepath.Clean(dir)] = true
+		}
+	}
+
+	return ceilings
+}
+
+func deviceOf(path string) (uint64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return uint64(stat.Dev), true
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func expandTilde(path string) string {
+	if path == "~" {
+		return os.Getenv("HOME")
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
@@ -5,7 +5,11 @@ package main
  */
 
 import (
+	"fmt"
 	"github.com/fatih/color"
+	"path"
+	"strings"
+	"time"
 )
 
 //
@@ -14,7 +18,7 @@ import (
 
 type RepoChangeStatus struct {
 	OutputCharacter rune
-	OutputColor     *color.Color
+	OutputColor     color.Attribute
 	Meaning         string
 }
 
@@ -24,54 +28,157 @@ type RepoChangeStatusVCSFields struct {
 	StatusCodes map[rune]RepoChangeStatus
 }
 
+// Not a file status: counts stashes (git) or shelves (hg)
+const StashStatusCode = '$'
+
 // What order to print status out in
 var GitRepoChangeStatusFieldDefinitions = map[rune]RepoChangeStatus{
-	'M': {OutputCharacter: 'M', OutputColor: color.New(color.FgGreen), Meaning: "modified"},
-	'A': {OutputCharacter: '+', OutputColor: color.New(color.FgHiGreen), Meaning: "added"},
-	'D': {OutputCharacter: '-', OutputColor: color.New(color.FgHiRed), Meaning: "deleted"},
-	'R': {OutputCharacter: 'R', OutputColor: color.New(color.FgHiYellow), Meaning: "renamed"},
-	'C': {OutputCharacter: 'C', OutputColor: color.New(color.FgHiBlue), Meaning: "copied"},
-	'U': {OutputCharacter: 'U', OutputColor: color.New(color.FgHiMagenta), Meaning: "updated"},
-	'?': {OutputCharacter: '?', OutputColor: color.New(color.FgRed), Meaning: "untracked"},
-	'!': {OutputCharacter: '!', OutputColor: color.New(color.FgCyan), Meaning: "ignored"},
+	'M': {OutputCharacter: 'M', OutputColor: color.FgGreen, Meaning: "modified"},
+	'A': {OutputCharacter: '+', OutputColor: color.FgHiGreen, Meaning: "added"},
+	'D': {OutputCharacter: '-', OutputColor: color.FgHiRed, Meaning: "deleted"},
+	'R': {OutputCharacter: 'R', OutputColor: color.FgHiYellow, Meaning: "renamed"},
+	'C': {OutputCharacter: 'C', OutputColor: color.FgHiBlue, Meaning: "copied"},
+	'U': {OutputCharacter: 'U', OutputColor: color.FgHiMagenta, Meaning: "updated"},
+	'?': {OutputCharacter: '?', OutputColor: color.FgRed, Meaning: "untracked"},
+	'!': {OutputCharacter: '!', OutputColor: color.FgCyan, Meaning: "ignored"},
+	'$': {OutputCharacter: '$', OutputColor: color.FgHiBlue, Meaning: "stashed"},
 }
 
 var HgRepoChangeStatusFieldDefinitions = map[rune]RepoChangeStatus{
-	'M': {OutputCharacter: 'M', OutputColor: color.New(color.FgGreen), Meaning: "modified"},
-	'A': {OutputCharacter: '+', OutputColor: color.New(color.FgHiGreen), Meaning: "added"},
-	'R': {OutputCharacter: '-', OutputColor: color.New(color.FgHiRed), Meaning: "removed"},
-	'C': {OutputCharacter: '=', OutputColor: color.New(color.FgWhite), Meaning: "clean"},
-	'!': {OutputCharacter: 'm', OutputColor: color.New(color.FgHiMagenta), Meaning: "missing"},
-	'?': {OutputCharacter: '?', OutputColor: color.New(color.FgRed), Meaning: "untracked"},
-	'I': {OutputCharacter: '!', OutputColor: color.New(color.FgCyan), Meaning: "ignored"},
+	'M': {OutputCharacter: 'M', OutputColor: color.FgGreen, Meaning: "modified"},
+	'A': {OutputCharacter: '+', OutputColor: color.FgHiGreen, Meaning: "added"},
+	'R': {OutputCharacter: '-', OutputColor: color.FgHiRed, Meaning: "removed"},
+	'C': {OutputCharacter: '=', OutputColor: color.FgWhite, Meaning: "clean"},
+	'!': {OutputCharacter: 'm', OutputColor: color.FgHiMagenta, Meaning: "missing"},
+	'?': {OutputCharacter: '?', OutputColor: color.FgRed, Meaning: "untracked"},
+	'I': {OutputCharacter: '!', OutputColor: color.FgCyan, Meaning: "ignored"},
+	'$': {OutputCharacter: '$', OutputColor: color.FgHiBlue, Meaning: "shelved"},
+}
+
+var JujutsuRepoChangeStatusFieldDefinitions = map[rune]RepoChangeStatus{
+	'M': {OutputCharacter: 'M', OutputColor: color.FgGreen, Meaning: "modified"},
+	'A': {OutputCharacter: '+', OutputColor: color.FgHiGreen, Meaning: "added"},
+	'D': {OutputCharacter: '-', OutputColor: color.FgHiRed, Meaning: "deleted"},
+	'R': {OutputCharacter: 'R', OutputColor: color.FgHiYellow, Meaning: "renamed"},
+	'C': {OutputCharacter: 'C', OutputColor: color.FgHiBlue, Meaning: "copied"},
 }
 
-var RepoChangeStatusFieldDefinitions = map[string]RepoChangeStatusVCSFields{
-	"git": {VCS: "git", StatusCodes: GitRepoChangeStatusFieldDefinitions,
-		OrderedKeys: []rune{'M', 'A', 'D', 'R', 'C', 'U', '?', '!'}},
-	"hg": {VCS: "hg", StatusCodes: HgRepoChangeStatusFieldDefinitions,
-		OrderedKeys: []rune{'M', 'A', 'R', 'C', '!', '?', 'I'}},
+var SubversionRepoChangeStatusFieldDefinitions = map[rune]RepoChangeStatus{
+	'M': {OutputCharacter: 'M', OutputColor: color.FgGreen, Meaning: "modified"},
+	'A': {OutputCharacter: '+', OutputColor: color.FgHiGreen, Meaning: "added"},
+	'D': {OutputCharacter: '-', OutputColor: color.FgHiRed, Meaning: "deleted"},
+	'R': {OutputCharacter: 'R', OutputColor: color.FgHiYellow, Meaning: "replaced"},
+	'G': {OutputCharacter: 'G', OutputColor: color.FgHiBlue, Meaning: "merged"},
+	'C': {OutputCharacter: 'C', OutputColor: color.FgHiMagenta, Meaning: "conflicted"},
+	'!': {OutputCharacter: 'm', OutputColor: color.FgHiMagenta, Meaning: "missing"},
+	'~': {OutputCharacter: '~', OutputColor: color.FgHiMagenta, Meaning: "obstructed"},
+	'X': {OutputCharacter: 'X', OutputColor: color.FgWhite, Meaning: "external"},
+	'?': {OutputCharacter: '?', OutputColor: color.FgRed, Meaning: "unversioned"},
+	'I': {OutputCharacter: '!', OutputColor: color.FgCyan, Meaning: "ignored"},
 }
 
+var FossilRepoChangeStatusFieldDefinitions = map[rune]RepoChangeStatus{
+	'M': {OutputCharacter: 'M', OutputColor: color.FgGreen, Meaning: "edited"},
+	'A': {OutputCharacter: '+', OutputColor: color.FgHiGreen, Meaning: "added"},
+	'D': {OutputCharacter: '-', OutputColor: color.FgHiRed, Meaning: "deleted"},
+	'R': {OutputCharacter: 'R', OutputColor: color.FgHiYellow, Meaning: "renamed"},
+	'C': {OutputCharacter: 'C', OutputColor: color.FgHiMagenta, Meaning: "conflict"},
+	'!': {OutputCharacter: 'm', OutputColor: color.FgHiMagenta, Meaning: "missing"},
+	'?': {OutputCharacter: '?', OutputColor: color.FgRed, Meaning: "extra"},
+}
+
+// Filled in as backends register, keyed by VCS
+var RepoChangeStatusFieldDefinitions = map[string]RepoChangeStatusVCSFields{}
+
 type AnsiString struct {
 	Plain   string `json:"plain"`
 	Colored string `json:"colored"`
 }
 
+type RepoFileStatus struct {
+	Path      string `json:"path"`
+	OrigPath  string `json:"orig_path,omitempty"`
+	Code      string `json:"code"`
+	Submodule string `json:"submodule,omitempty"`
+}
+
+// An unfinished operation, like a merge or a rebase at step 2 of 5
+type RepoOperation struct {
+	Name   string `json:"name"`
+	Step   int    `json:"step,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// Short form for prompts, e.g. "REBASE 2/5"
+func (o *RepoOperation) Label() string {
+	var label string
+	switch o.Name {
+	case "rebasing":
+		label = "REBASE"
+	case "applying-mailbox":
+		label = "AM"
+	case "cherry-picking":
+		label = "CHERRY-PICKING"
+	default:
+		label = strings.ToUpper(o.Name)
+	}
+
+	if o.Total > 0 {
+		label += fmt.Sprintf(" %d/%d", o.Step, o.Total)
+	}
+
+	return label
+}
+
+// A repository enclosing the one being reported on
+type ParentRepo struct {
+	VCS      string `json:"vcs"`
+	RepoPath string `json:"repo_path"`
+}
+
 type RepoInfo struct {
-	IsRepo             bool         `json:"is_repo"`
-	VCS                AnsiString   `json:"vcs"`
-	VCSColor           *color.Color `json:"vcs_color"`
-	RepoName           string       `json:"repo_name"`
-	BranchName         AnsiString   `json:"current_branch"`
-	BranchTrackingInfo AnsiString   `json:"tracking"`
-	OtherBranches      []AnsiString `json:"branches"`
-	ChangeStatusCounts map[rune]int `json:"status_counts"`
-	Status             AnsiString   `json:"status"`
-	RepoPath           string       `json:"repo_path"`
-}
-
-func buildColoredStatusStringFromMap(status map[rune]int, codes *RepoChangeStatusVCSFields) string {
+	IsRepo             bool             `json:"is_repo"`
+	VCS                AnsiString       `json:"vcs"`
+	VCSColor           color.Attribute  `json:"vcs_color"`
+	RepoName           string           `json:"repo_name"`
+	BranchName         AnsiString       `json:"current_branch"`
+	IsDefaultBranch    bool             `json:"is_default_branch"`
+	DetachedCommit     string           `json:"detached_commit,omitempty"`
+	Operation          *RepoOperation   `json:"operation,omitempty"`
+	BranchTrackingInfo AnsiString       `json:"tracking"`
+	Upstream           string           `json:"upstream"`
+	Ahead              int              `json:"ahead"`
+	Behind             int              `json:"behind"`
+	UpstreamGone       bool             `json:"upstream_gone"`
+	OtherBranches      []AnsiString     `json:"branches"`
+	ActiveBookmark     AnsiString       `json:"active_bookmark"`
+	Bookmarks          []AnsiString     `json:"bookmarks,omitempty"`
+	ChangeStatusCounts map[rune]int     `json:"status_counts"`
+	StashCount         int              `json:"stash_count"`
+	StashMessage       string           `json:"stash_message,omitempty"`
+	Status             AnsiString       `json:"status"`
+	Files              []RepoFileStatus `json:"files,omitempty"`
+	Jujutsu            *JujutsuInfo     `json:"jj,omitempty"`
+	Subversion         *SubversionInfo  `json:"svn,omitempty"`
+	Fossil             *FossilInfo      `json:"fossil,omitempty"`
+	RepoPath           string           `json:"repo_path"`
+	TimedOut           bool             `json:"timed_out"`
+	Stale              bool             `json:"stale"`
+	AgeSeconds         float64          `json:"age_seconds"`
+	IsBare             bool             `json:"is_bare"`
+	IsGitDir           bool             `json:"is_git_dir"`
+	ParentRepos        []ParentRepo     `json:"parent_repos,omitempty"`
+	SuperprojectPath   string           `json:"superproject_path,omitempty"`
+	SuperprojectName   string           `json:"superproject_name,omitempty"`
+	Submodules         *GitSubmodules   `json:"submodules,omitempty"`
+	MainWorktreePath   string           `json:"main_worktree_path,omitempty"`
+	WorktreeName       string           `json:"worktree_name,omitempty"`
+	IsMainWorktree     bool             `json:"is_main_worktree"`
+	OtherWorktrees     []GitWorktree    `json:"other_worktrees,omitempty"`
+}
+
+func buildColoredStatusStringFromMap(status map[rune]int, codes *RepoChangeStatusVCSFields, r *Renderer) string {
 	retval := ""
 
 	for _, key := range codes.OrderedKeys {
@@ -82,10 +189,166 @@ func buildColoredStatusStringFromMap(status map[rune]int, codes *RepoChangeStatu
 				retval += " "
 			}
 
-			retval += codes.StatusCodes[key].OutputColor.Sprintf("%c:%d",
+			retval += r.Sprintf(codes.StatusCodes[key].OutputColor, "%c:%d",
 				codes.StatusCodes[key].OutputCharacter, count)
 		}
 	}
 
 	return retval
 }
+
+// Tracking information as "branch...upstream [ahead N, behind M]"
+func buildTrackingInfo(branch string, upstream string, ahead int, behind int, gone bool, r *Renderer) AnsiString {
+	green := r.New(color.FgGreen)
+	red := r.New(color.FgRed)
+
+	plain := branch
+	colored := green.Sprint(branch)
+
+	if upstream == "" {
+		return AnsiString{Plain: plain, Colored: colored}
+	}
+
+	plain += "..." + upstream
+	colored += "..." + red.Sprint(upstream)
+
+	if gone {
+		plain += " [gone]"
+		colored += " [" + red.Sprint("gone") + "]"
+		return AnsiString{Plain: plain, Colored: colored}
+	}
+
+	var plainCounts, coloredCounts []string
+	if ahead > 0 {
+		plainCounts = append(plainCounts, fmt.Sprintf("ahead %d", ahead))
+		coloredCounts = append(coloredCounts, "ahead "+green.Sprint(ahead))
+	}
+	if behind > 0 {
+		plainCounts = append(plainCounts, fmt.Sprintf("behind %d", behind))
+		coloredCounts = append(coloredCounts, "behind "+red.Sprint(behind))
+	}
+
+	if len(plainCounts) > 0 {
+		plain += " [" + strings.Join(plainCounts, ", ") + "]"
+		colored += " [" + strings.Join(coloredCounts, ", ") + "]"
+	}
+
+	return AnsiString{Plain: plain, Colored: colored}
+}
+
+// Ahead/behind counts as arrows, e.g. "↑2↓1"
+func buildTrackingArrows(info *RepoInfo, r *Renderer) string {
+	if info.Upstream == "" {
+		return ""
+	}
+
+	if info.UpstreamGone {
+		return r.Sprint(color.FgRed, "✗")
+	}
+
+	retval := ""
+	if info.Ahead > 0 {
+		retval += r.Sprintf(color.FgGreen, "↑%d", info.Ahead)
+	}
+	if info.Behind > 0 {
+		retval += r.Sprintf(color.FgRed, "↓%d", info.Behind)
+	}
+
+	return retval
+}
+
+// The detached commit and unfinished operation, e.g. "@1a2b3c4|REBASE 2/5"
+func buildOperationString(info *RepoInfo, r *Renderer) string {
+	retval := ""
+
+	if info.DetachedCommit != "" {
+		retval += r.Sprint(color.FgHiBlack, "@"+info.DetachedCommit)
+	}
+
+	if info.Operation != nil {
+		if retval != "" {
+			retval += "|"
+		}
+		retval += r.Sprint(currentConfig().Color("branch_merging"), info.Operation.Label())
+	}
+
+	return retval
+}
+
+// The superproject of a submodule, e.g. "^parent"
+func buildSuperprojectString(info *RepoInfo, r *Renderer) string {
+	if info.SuperprojectName == "" {
+		return ""
+	}
+	return r.Sprint(color.FgHiBlack, "^"+info.SuperprojectName)
+}
+
+// Submodules with changes, e.g. "sub:*1+2-1" for one dirty, two with new commits and one uninitialized
+func buildSubmoduleString(info *RepoInfo, r *Renderer) string {
+	if info.Submodules == nil {
+		return ""
+	}
+
+	retval := ""
+	if count := len(info.Submodules.Dirty); count > 0 {
+		retval += r.Sprintf(color.FgHiYellow, "*%d", count)
+	}
+	if count := len(info.Submodules.NewCommits); count > 0 {
+		retval += r.Sprintf(color.FgMagenta, "+%d", count)
+	}
+	if count := len(info.Submodules.Uninitialized); count > 0 {
+		retval += r.Sprintf(color.FgHiBlack, "-%d", count)
+	}
+
+	if retval == "" {
+		return ""
+	}
+	return "sub:" + retval
+}
+
+// The colored status counts, followed by the submodule summary and the age of a stale result when there are any
+func buildStatusWithSubmodules(info *RepoInfo, r *Renderer) string {
+	parts := []string{}
+	for _, part := range []string{info.Status.Colored, buildSubmoduleString(info, r), buildStaleString(info, r)} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// "~42s" for a stale result from the daemon, being reloaded in the background
+func buildStaleString(info *RepoInfo, r *Renderer) string {
+	if !info.Stale {
+		return ""
+	}
+
+	age := time.Duration(info.AgeSeconds * float64(time.Second)).Round(time.Second)
+	return r.Sprint(color.FgHiBlack, "~"+age.String())
+}
+
+// Marks info as missing whatever its backend hadn't gathered when the deadline passed
+func markTimedOut(info *RepoInfo, r *Renderer) {
+	info.TimedOut = true
+	info.ChangeStatusCounts = nil
+
+	status := "(status unknown)"
+	info.Status = AnsiString{Plain: status, Colored: r.Sprint(color.FgHiBlack, status)}
+}
+
+// For when the deadline passed before anything but the repository's location was known
+func newTimedOutRepoInfo(vcs string, root string, r *Renderer) *RepoInfo {
+	vcscolor := currentConfig().Color("vcs")
+
+	info := &RepoInfo{
+		IsRepo:        true,
+		VCS:           AnsiString{Plain: vcs, Colored: r.Sprint(vcscolor, vcs)},
+		VCSColor:      vcscolor,
+		RepoPath:      root,
+		RepoName:      path.Base(root),
+		OtherBranches: []AnsiString{},
+	}
+	markTimedOut(info, r)
+
+	return info
+}
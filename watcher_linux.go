@@ -0,0 +1,217 @@
+package main
+
+/**
+ * Filesystem change notification for the daemon's cache, using inotify
+ */
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const repoWatchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// Give up on (and don't cache) repositories with more directories than this
+const maxWatchesPerRepo = 16384
+
+// One inotify watch; nested repositories can share a directory
+type repoWatch struct {
+	dir   string
+	roots map[string]bool
+}
+
+type RepoWatcher struct {
+	fd       int
+	mutex    sync.Mutex
+	watches  map[int32]*repoWatch
+	roots    map[string][]int32
+	onChange func(root string)
+}
+
+func NewRepoWatcher(onChange func(root string)) (*RepoWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := &RepoWatcher{
+		fd:       fd,
+		watches:  map[int32]*repoWatch{},
+		roots:    map[string][]int32{},
+		onChange: onChange,
+	}
+
+	go watcher.readEvents()
+
+	return watcher, nil
+}
+
+// Start watching everything under a repository root, plus any directories (like a git dir) that live elsewhere
+func (w *RepoWatcher) Watch(root string, extraDirs ...string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.roots[root]; ok {
+		return nil
+	}
+
+	w.roots[root] = []int32{}
+
+	for _, dir := range append([]string{root}, extraDirs...) {
+		if err := w.addTree(root, dir); err != nil {
+			w.unwatchLocked(root)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *RepoWatcher) Unwatch(root string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.unwatchLocked(root)
+}
+
+func (w *RepoWatcher) unwatchLocked(root string) {
+	for _, wd := range w.roots[root] {
+		watch, ok := w.watches[wd]
+		if !ok {
+			continue
+		}
+
+		delete(watch.roots, root)
+		if len(watch.roots) == 0 {
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+	delete(w.roots, root)
+}
+
+func (w *RepoWatcher) addTree(root string, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		// Object databases churn without changing status
+		if info.Name() == "objects" && fileExists(filepath.Join(filepath.Dir(path), "HEAD")) {
+			return filepath.SkipDir
+		}
+		if info.Name() == "data" && filepath.Base(filepath.Dir(path)) == "store" {
+			return filepath.SkipDir
+		}
+		if info.Name() == "pristine" && filepath.Base(filepath.Dir(path)) == ".svn" {
+			return filepath.SkipDir
+		}
+		if info.Name() == "store" && filepath.Base(filepath.Dir(filepath.Dir(path))) == ".jj" {
+			// jj's commit store
+			return filepath.SkipDir
+		}
+		if (info.Name() == "working_copy" || strings.HasPrefix(info.Name(), "op_")) &&
+			(filepath.Base(filepath.Dir(path)) == ".jj" || filepath.Base(filepath.Dir(filepath.Dir(path))) == ".jj") {
+			// Every jj command snapshots the working copy and records an operation here, including ours
+			return filepath.SkipDir
+		}
+
+		if len(w.roots[root]) >= maxWatchesPerRepo {
+			return syscall.ENOSPC
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, repoWatchMask)
+		if err != nil {
+			return err
+		}
+
+		watch, ok := w.watches[int32(wd)]
+		if !ok {
+			watch = &repoWatch{dir: path, roots: map[string]bool{}}
+			w.watches[int32(wd)] = watch
+		}
+		if !watch.roots[root] {
+			watch.roots[root] = true
+			w.roots[root] = append(w.roots[root], int32(wd))
+		}
+
+		return nil
+	})
+}
+
+func (w *RepoWatcher) readEvents() {
+	buffer := make([]byte, 64*1024)
+
+	for {
+		n, err := syscall.Read(w.fd, buffer)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Printf("Error reading filesystem events: %s", err)
+			return
+		}
+
+		changed := map[string]bool{}
+
+		w.mutex.Lock()
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			name := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Lost events, so everything is suspect
+				for root := range w.roots {
+					changed[root] = true
+				}
+				continue
+			}
+
+			watch, ok := w.watches[event.Wd]
+			if !ok || isSelfModifiedRepoFile(cString(name)) {
+				continue
+			}
+
+			for root := range watch.roots {
+				changed[root] = true
+
+				// New directories need watches of their own
+				if event.Mask&syscall.IN_CREATE != 0 && event.Mask&syscall.IN_ISDIR != 0 {
+					_ = w.addTree(root, filepath.Join(watch.dir, cString(name)))
+				}
+			}
+
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// The kernel dropped this watch (the directory is gone)
+				delete(w.watches, event.Wd)
+			}
+		}
+		w.mutex.Unlock()
+
+		for root := range changed {
+			w.onChange(root)
+		}
+	}
+}
+
+// Files our own loads write to, which would otherwise drop every result as soon as it's stored
+func isSelfModifiedRepoFile(name string) bool {
+	// fossil's checkout database (and its journal), updated by `fossil changes`
+	return strings.HasPrefix(name, ".fslckout") || strings.HasPrefix(name, "_FOSSIL_")
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+/**
+ * Filesystem change notification isn't implemented here, so the daemon won't cache
+ */
+
+import (
+	"errors"
+)
+
+type RepoWatcher struct{}
+
+func NewRepoWatcher(onChange func(root string)) (*RepoWatcher, error) {
+	return nil, errors.New("filesystem change notification is not supported on this platform")
+}
+
+func (w *RepoWatcher) Watch(root string, extraDirs ...string) error {
+	return errors.New("filesystem change notification is not supported on this platform")
+}
+
+func (w *RepoWatcher) Unwatch(root string) {
+}